@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/300481/kitops/pkg/kitops"
 	cli "github.com/urfave/cli/v2"
@@ -10,6 +19,14 @@ import (
 
 var (
 	app = cli.NewApp()
+
+	// serverFlag is the URL of the server the commands are sent to
+	serverFlag = &cli.StringFlag{
+		Name:    "server",
+		Usage:   "URL of the kitops server",
+		Value:   "http://localhost:8080",
+		EnvVars: []string{"KITOPS_SERVER"},
+	}
 )
 
 func init() {
@@ -32,7 +49,161 @@ func commands() {
 				return nil
 			},
 		},
+		{
+			Name:      "plan",
+			Aliases:   []string{"p"},
+			Usage:     "Show the changes applying a commit would make",
+			ArgsUsage: "COMMITID",
+			Flags:     []cli.Flag{serverFlag},
+			Action: func(c *cli.Context) error {
+				body, err := get(serverURL(c, "/plan", c.Args().First()))
+				if err != nil {
+					return err
+				}
+
+				var plan bytes.Buffer
+				if err := json.Indent(&plan, body, "", "  "); err != nil {
+					return err
+				}
+				_, err = plan.WriteTo(os.Stdout)
+				return err
+			},
+		},
+		{
+			Name:      "diff",
+			Aliases:   []string{"d"},
+			Usage:     "Show the differences between a commit and the cluster",
+			ArgsUsage: "COMMITID",
+			Flags:     []cli.Flag{serverFlag},
+			Action: func(c *cli.Context) error {
+				body, err := get(serverURL(c, "/diff", c.Args().First()))
+				if err != nil {
+					return err
+				}
+
+				var diff kitops.Diff
+				if err := json.Unmarshal(body, &diff); err != nil {
+					return err
+				}
+
+				fmt.Print(diff.String())
+				for _, e := range diff.Errors {
+					log.Println(e)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "rollback",
+			Usage:     "Apply a previously applied commit again on the running server",
+			ArgsUsage: "[COMMITID]",
+			Description: "Rolls back to the commit, or to the commit applied before the current one\n" +
+				"if none is given, and cleans up the resources added after it.",
+			Flags: []cli.Flag{
+				serverFlag,
+				&cli.BoolFlag{
+					Name:  "plan",
+					Usage: "show the plan and ask for confirmation first",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				query := url.Values{}
+				if to := c.Args().First(); len(to) > 0 {
+					query.Set("to", to)
+				}
+				rollbackURL := strings.TrimSuffix(c.String("server"), "/") + "/rollback?"
+
+				if c.Bool("plan") {
+					plan, err := post(rollbackURL + query.Encode() + "&plan=true")
+					if err != nil {
+						return err
+					}
+					fmt.Print(string(plan))
+
+					fmt.Print("Roll back? [y/N] ")
+					answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+					if strings.TrimSpace(strings.ToLower(answer)) != "y" {
+						return errors.New("rollback cancelled")
+					}
+				}
+
+				rollback, err := post(rollbackURL + query.Encode())
+				if err != nil {
+					return err
+				}
+				fmt.Print(string(rollback))
+				return nil
+			},
+		},
+		{
+			Name:        "restore",
+			Aliases:     []string{"r"},
+			Usage:       "Restore the objects updated or pruned by a commit from the backup",
+			ArgsUsage:   "COMMITID",
+			Description: "Restores the objects on the running server, after the commit in progress.",
+			Flags:       []cli.Flag{serverFlag},
+			Action: func(c *cli.Context) error {
+				body, err := post(serverURL(c, "/restore", c.Args().First()))
+				if err != nil {
+					return err
+				}
+
+				var restore kitops.Restore
+				if err := json.Unmarshal(body, &restore); err != nil {
+					return err
+				}
+
+				for _, r := range restore.Restored {
+					fmt.Printf("restored %s %s %s\n", r.Kind, r.Metadata.Namespace, r.Metadata.Name)
+				}
+				if len(restore.Error) > 0 {
+					return errors.New(restore.Error)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// serverURL returns the url of the path on the server with the commitID as query
+func serverURL(c *cli.Context, path, commitID string) string {
+	query := url.Values{}
+	query.Set("commitid", commitID)
+	return strings.TrimSuffix(c.String("server"), "/") + path + "?" + query.Encode()
+}
+
+// get sends a GET request to the url
+// returns the response body and an error if the request failed
+func get(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	return readBody(resp)
+}
+
+// post sends a POST request to the url
+// returns the response body and an error if the request failed
+func post(url string) ([]byte, error) {
+	resp, err := http.Post(url, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return readBody(resp)
+}
+
+// readBody returns the body of the response and an error if the status isn't OK
+func readBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, body)
 	}
+	return body, nil
 }
 
 func main() {
@@ -1,19 +1,28 @@
 package kitops
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
-	"os/exec"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
 )
 
 // APIResource holds the object information of the API Object
 type APIResource struct {
-	Kind     string
-	Metadata struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string
+	Metadata   struct {
 		Name      string
 		Namespace string
 	}
@@ -38,66 +47,84 @@ func NewResource(r io.Reader) (resource *APIResource, err error) {
 	return &ar, nil
 }
 
-// Exists returns a bool. true if the Object exists in the cluster, false if not
-// It returns also false, when there is no information if the resource is namespaced
-func (r *APIResource) Exists() bool {
-	var commandArguments []string
-	if kinds.namespaced(r.Kind) {
-		commandArguments = []string{
-			"-n",
-			r.Metadata.Namespace,
-			"get",
-			r.Kind,
-			r.Metadata.Name,
+// newResourceFromObject returns the API Resource of an object read from the cluster
+func newResourceFromObject(obj *unstructured.Unstructured) *APIResource {
+	var ar APIResource
+	ar.APIVersion = obj.GetAPIVersion()
+	ar.Kind = obj.GetKind()
+	ar.Metadata.Name = obj.GetName()
+	ar.Metadata.Namespace = obj.GetNamespace()
+
+	if len(ar.Metadata.Namespace) == 0 {
+		ar.Metadata.Namespace = "default"
+	}
+
+	return &ar
+}
+
+// decodeManifest decodes all objects of a YAML manifest with one or more documents
+// returns an error, if the manifest contains no valid yaml
+func decodeManifest(manifest []byte) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+
+	dec := k8syaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 4096)
+	for {
+		var content map[string]interface{}
+		err := dec.Decode(&content)
+		if err == io.EOF {
+			break
 		}
-	} else {
-		commandArguments = []string{
-			"get",
-			r.Kind,
-			r.Metadata.Name,
+		if err != nil {
+			return nil, err
+		}
+
+		// skip empty documents
+		if len(content) == 0 {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{Object: content}
+		if !obj.IsList() {
+			objects = append(objects, obj)
+			continue
+		}
+
+		err = obj.EachListItem(func(item runtime.Object) error {
+			objects = append(objects, item.(*unstructured.Unstructured))
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	err := exec.Command("kubectl", commandArguments...).Run()
+	return objects, nil
+}
+
+// Exists returns a bool. true if the Object exists in the cluster, false if not
+// It returns also false, when the existence could not be determined
+func (r *APIResource) Exists(client ClusterClient) bool {
+	_, err := client.Get(r)
+	if errors.IsNotFound(err) {
+		return false
+	}
 	if err != nil {
-		log.Println("Error running command: kubectl ", commandArguments)
+		log.Printf("Error getting resource Kind: %s Name: %s Namespace: %s: %v", r.Kind, r.Metadata.Name, r.Metadata.Namespace, err)
 		return false
 	}
 
 	return true
 }
 
-// Label labels the resource in the cluster
-func (r *APIResource) Label(label string) {
-	if !r.Exists() {
+// Label sets the labels and annotations of the resource in the cluster
+func (r *APIResource) Label(client ClusterClient, labels map[string]string, annotations map[string]string) {
+	if !r.Exists(client) {
 		log.Println("Warning: resource to label don't exists. Kind: " + r.Kind + " Name: " + r.Metadata.Name + " Namespace: " + r.Metadata.Namespace)
 		return
 	}
 
-	var commandArguments []string
-	if kinds.namespaced(r.Kind) {
-		commandArguments = []string{
-			"-n",
-			r.Metadata.Namespace,
-			"label",
-			"--overwrite",
-			r.Kind,
-			r.Metadata.Name,
-			label,
-		}
-	} else {
-		commandArguments = []string{
-			"label",
-			"--overwrite",
-			r.Kind,
-			r.Metadata.Name,
-			label,
-		}
-	}
-
-	err := exec.Command("kubectl", commandArguments...).Run()
-	if err != nil {
-		log.Println("Error running command: kubectl ", commandArguments)
+	if err := client.Label(r, labels, annotations); err != nil {
+		log.Printf("Error labelling resource Kind: %s Name: %s Namespace: %s: %v", r.Kind, r.Metadata.Name, r.Metadata.Namespace, err)
 		return
 	}
 
@@ -106,42 +133,47 @@ func (r *APIResource) Label(label string) {
 	return
 }
 
-// Checksum returns a SHA256 checksum of the APIResource as a string
+// GroupVersionKind returns the group, version and kind of the resource
+func (r *APIResource) GroupVersionKind() schema.GroupVersionKind {
+	return schema.FromAPIVersionAndKind(r.APIVersion, r.Kind)
+}
+
+// Checksum returns a SHA256 checksum of the identity of the APIResource as a string
+// The identity is the group, kind, namespace and name. The version is left out,
+// since the versions of a group are representations of the same object and the
+// cluster lists objects in its preferred version.
 func (r *APIResource) Checksum() string {
-	s := fmt.Sprintf("%v", *r)
+	s := strings.Join([]string{r.GroupVersionKind().Group, r.Kind, r.Metadata.Namespace, r.Metadata.Name}, "/")
 	sum := sha256.Sum256([]byte(s))
 	return fmt.Sprintf("%x", sum)
 }
 
 // Delete deletes the resource from the cluster
-func (r *APIResource) Delete() {
-	if !r.Exists() {
-		return
+// returns an error if the resource exists, but can't be deleted
+func (r *APIResource) Delete(client ClusterClient, opts DeleteOptions) error {
+	if !r.Exists(client) {
+		return nil
 	}
 
-	var commandArguments []string
-	if kinds.namespaced(r.Kind) {
-		commandArguments = []string{
-			"-n",
-			r.Metadata.Namespace,
-			"delete",
-			r.Kind,
-			r.Metadata.Name,
-		}
-	} else {
-		commandArguments = []string{
-			"delete",
-			r.Kind,
-			r.Metadata.Name,
-		}
-	}
-
-	err := exec.Command("kubectl", commandArguments...).Run()
-	if err != nil {
-		log.Println("Error running command: kubectl ", commandArguments)
+	if err := client.Delete(r, opts); err != nil {
+		log.Printf("Error deleting resource Kind: %s Name: %s Namespace: %s: %v", r.Kind, r.Metadata.Name, r.Metadata.Namespace, err)
+		return err
 	}
 
 	log.Printf("Cleanup Resource Kind: %s Name: %s Namespace: %s", r.Kind, r.Metadata.Name, r.Metadata.Namespace)
 
-	return
+	return nil
+}
+
+// waitForDeleted waits until the resource is gone from the cluster
+// returns an error on timeout or if the context is canceled
+func (r *APIResource) waitForDeleted(ctx context.Context, client ClusterClient, timeout time.Duration) error {
+	err := poll(ctx, timeout, func() (bool, error) {
+		_, err := client.Get(r)
+		return errors.IsNotFound(err), nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s %s not deleted: %v", r.Kind, r.Metadata.Name, err)
+	}
+	return nil
 }
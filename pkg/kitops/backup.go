@@ -0,0 +1,124 @@
+package kitops
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	defaultBackupDirectory = "/tmp/backup"
+	defaultBackupRetention = 10
+)
+
+// Archive keeps the backups of the live objects changed by commits
+// in a directory per commit
+type Archive struct {
+	// Directory is the directory holding the backups
+	Directory string
+	// Retention is the number of backups kept. 0 keeps all.
+	Retention int
+}
+
+// Backup holds the live objects of the cluster before
+// they were updated or pruned by a commit
+type Backup struct {
+	archive   *Archive
+	directory string
+}
+
+// Backup returns the backup of the objects changed by the commitID
+func (a *Archive) Backup(commitID string) *Backup {
+	return &Backup{
+		archive:   a,
+		directory: filepath.Join(a.Directory, commitID),
+	}
+}
+
+// Save stores the live object in the backup
+// A nil backup doesn't store anything.
+func (b *Backup) Save(obj *unstructured.Unstructured) error {
+	if b == nil || obj == nil {
+		return nil
+	}
+
+	manifest, err := normalizedYAML(obj)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(b.directory); os.IsNotExist(err) {
+		if err := os.MkdirAll(b.directory, 0755); err != nil {
+			return err
+		}
+		b.archive.prune()
+	}
+
+	path := filepath.Join(b.directory, backupFileName(obj))
+	return ioutil.WriteFile(path, []byte(manifest), 0644)
+}
+
+// Load returns the objects stored in the backup
+// returns an error if there is no backup or it can't be read
+func (b *Backup) Load() ([]*unstructured.Unstructured, error) {
+	files, err := ioutil.ReadDir(b.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*unstructured.Unstructured
+	for _, file := range files {
+		manifest, err := ioutil.ReadFile(filepath.Join(b.directory, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := decodeManifest(manifest)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, decoded...)
+	}
+	return objects, nil
+}
+
+// prune removes the oldest backups exceeding the retention
+func (a *Archive) prune() {
+	if a.Retention <= 0 {
+		return
+	}
+
+	backups, err := ioutil.ReadDir(a.Directory)
+	if err != nil {
+		log.Printf("Error reading backups: %v", err)
+		return
+	}
+	if len(backups) <= a.Retention {
+		return
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].ModTime().Before(backups[j].ModTime())
+	})
+	for _, backup := range backups[:len(backups)-a.Retention] {
+		log.Printf("Remove backup of commit %s", backup.Name())
+		if err := os.RemoveAll(filepath.Join(a.Directory, backup.Name())); err != nil {
+			log.Printf("Error removing backup of commit %s: %v", backup.Name(), err)
+		}
+	}
+}
+
+// backupFileName returns the file name of the object in a backup
+// The parts are separated by underscores, which are invalid in names.
+func backupFileName(obj *unstructured.Unstructured) string {
+	parts := []string{obj.GroupVersionKind().GroupKind().String()}
+	if len(obj.GetNamespace()) > 0 {
+		parts = append(parts, obj.GetNamespace())
+	}
+	parts = append(parts, obj.GetName())
+	return strings.Join(parts, "_") + ".yaml"
+}
@@ -0,0 +1,96 @@
+package kitops_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/300481/kitops/pkg/kitops"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestBackup(t *testing.T) {
+	directory, err := ioutil.TempDir("", "kitops-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	archive := &kitops.Archive{Directory: directory}
+
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{
+			"app.yaml":    appManifest,
+			"config.yaml": configManifest,
+		},
+		map[string]string{"app.yaml": strings.Replace(appManifest, "replicas: 1", "replicas: 2", 1)},
+	)
+	cluster := kitops.NewFakeCluster()
+
+	for _, commitID := range commitIDs {
+		cc := kitops.NewClusterConfig(repo, commitID, cluster)
+		cc.Backup = archive.Backup(commitID)
+		if err := cc.ApplyManifests(); err != nil {
+			t.Fatal(err)
+		}
+		cc.Label()
+		cc.Clean()
+	}
+
+	if _, err := archive.Backup(commitIDs[0]).Load(); !os.IsNotExist(err) {
+		t.Errorf("got backup of the first commit, want none: %v", err)
+	}
+
+	objects, err := archive.Backup(commitIDs[1]).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]bool{}
+	for _, obj := range objects {
+		kinds[obj.GetKind()] = true
+		if obj.GetKind() == "Deployment" {
+			replicas, _, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "replicas")
+			if fmt.Sprint(replicas) != "1" {
+				t.Errorf("got backup of %v replicas, want 1", replicas)
+			}
+		}
+	}
+	if len(objects) != 2 || !kinds["Deployment"] || !kinds["ConfigMap"] {
+		t.Errorf("got backup of %v, want the updated Deployment and the pruned ConfigMap", kinds)
+	}
+}
+
+func TestBackupRetention(t *testing.T) {
+	directory, err := ioutil.TempDir("", "kitops-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	archive := &kitops.Archive{Directory: directory, Retention: 2}
+
+	cluster := kitops.NewFakeCluster()
+	deploy(t, cluster, "0", map[string]string{"config.yaml": configManifest})
+	var config kitops.APIResource
+	config.APIVersion = "v1"
+	config.Kind = "ConfigMap"
+	config.Metadata.Name = "config"
+	obj, err := cluster.Get(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, commitID := range []string{"1", "2", "3"} {
+		if err := archive.Backup(commitID).Save(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name() != "2" || files[1].Name() != "3" {
+		t.Errorf("got %d backups, want the ones of commit 2 and 3", len(files))
+	}
+}
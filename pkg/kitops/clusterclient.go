@@ -0,0 +1,92 @@
+package kitops
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ClusterClient is the interface to the cluster configured by kitops
+type ClusterClient interface {
+	// Kinds returns the API information of all Kinds served by the cluster
+	Kinds() map[schema.GroupKind]KindInfo
+
+	// Get returns the object of the resource from the cluster
+	// returns a NotFound error if it doesn't exist
+	Get(r *APIResource) (*unstructured.Unstructured, error)
+
+	// List returns all objects of the Kind in all namespaces
+	// matching the label selector
+	List(kind KindInfo, labelSelector string) ([]unstructured.Unstructured, error)
+
+	// Apply creates the object in the cluster or updates the existing one
+	// returns the resulting object and the action taken or planned for it
+	Apply(obj *unstructured.Unstructured, opts ApplyOptions) (*unstructured.Unstructured, ApplyAction, error)
+
+	// Label sets the labels and annotations on the resource in the cluster
+	// keeping the other labels and annotations of the resource
+	Label(r *APIResource, labels map[string]string, annotations map[string]string) error
+
+	// Delete deletes the resource from the cluster
+	Delete(r *APIResource, opts DeleteOptions) error
+}
+
+// DeleteOptions holds the options for deleting objects
+type DeleteOptions struct {
+	// Propagation is the policy for deleting the dependents of the object,
+	// the default policy of the object's kind if empty
+	Propagation metav1.DeletionPropagation
+}
+
+// ApplyOptions holds the options for applying objects
+type ApplyOptions struct {
+	// DryRun only determines the action and the resulting object
+	// without changing the cluster
+	DryRun bool
+	// ServerSide applies with server-side apply as the kitops field manager
+	ServerSide bool
+	// Force takes the ownership of fields conflicting with other field managers
+	// on server-side apply, otherwise the apply fails with the conflicts
+	Force bool
+}
+
+// ApplyAction is the action of applying an object to the cluster
+type ApplyAction string
+
+// Actions of applying an object
+const (
+	Created   ApplyAction = "Created"
+	Updated   ApplyAction = "Updated"
+	Unchanged ApplyAction = "Unchanged"
+	// Replaced objects were deleted and created again,
+	// since immutable fields were changed
+	Replaced ApplyAction = "Replaced"
+	// Failed objects couldn't be applied
+	Failed ApplyAction = "Failed"
+	// Skipped objects weren't applied, since a previous sync wave failed
+	Skipped ApplyAction = "Skipped"
+)
+
+// ApplyResult holds the result of applying a resource
+type ApplyResult struct {
+	Resource *APIResource
+	Action   ApplyAction
+	Error    string `json:",omitempty"`
+}
+
+// KindInfo holds the API information of a Kind
+type KindInfo struct {
+	Resource   schema.GroupVersionResource
+	Namespaced bool
+	Verbs      []string
+}
+
+// Supports returns a bool if the API of the Kind supports the verb
+func (ki KindInfo) Supports(verb string) bool {
+	for _, v := range ki.Verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
@@ -1,14 +1,15 @@
 package kitops
 
 import (
-	"io/ioutil"
+	"context"
+	"fmt"
 	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/300481/kitops/pkg/sourcerepo"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 // ClusterConfig holds all API Resources for a commit id
@@ -17,18 +18,54 @@ type ClusterConfig struct {
 	SourceRepository *sourcerepo.SourceRepo
 	CommitID         string
 	ResourceLabel    string
+	ApplyOptions     ApplyOptions
+	PruneOptions     PruneOptions
+	// HookDeletePolicy is the deletion policy of hooks without one
+	HookDeletePolicy string
+	// HealthTimeout is the time to wait for the applied resources to become healthy
+	HealthTimeout time.Duration
+	// ReplaceOnConflict replaces all resources failing with changed immutable fields,
+	// not only the annotated ones
+	ReplaceOnConflict bool
+	// Backup stores the live objects before they are updated or pruned,
+	// nil disables the backup
+	Backup *Backup `json:"-"`
+	// InventoryNamespace is the namespace of the inventory ConfigMap
+	InventoryNamespace string
+	// Waves holds the resources in the sync waves they are applied in
+	Waves []Wave
+	// Results holds the result of applying each resource
+	Results []*ApplyResult
+	// Health holds the health of the resources after they were applied
+	Health []*ResourceHealth
+	// Pruned holds the resources deleted by Clean
+	Pruned []*APIResource
+	// RollbackOf is the failed commit this one was applied again for
+	RollbackOf string `json:",omitempty"`
+	// RolledBackTo is the commit applied again after this one failed
+	RolledBackTo string `json:",omitempty"`
+	// applied is true after resources were applied to the cluster
+	applied bool
+	// PruneAborted holds the reason if Clean was aborted
+	PruneAborted string `json:",omitempty"`
+	client       ClusterClient
 }
 
 // NewClusterConfig returns an initialized *ClusterConfig
 // sourceRepo is the Repository with the configuration
 // commitID is the commit id of the source repository.
-func NewClusterConfig(sourceRepo *sourcerepo.SourceRepo, commitID string) *ClusterConfig {
-	resourceLabel := "managedBy=" + strings.ReplaceAll(strings.ReplaceAll(sourceRepo.URL, ":", "-"), "/", "-")
+// client is the client of the cluster to configure.
+func NewClusterConfig(sourceRepo *sourcerepo.SourceRepo, commitID string, client ClusterClient) *ClusterConfig {
+	resourceLabel := ownerSelector(sourceRepo.URL)
 	return &ClusterConfig{
-		APIResources:     NewCollection(resourceLabel),
-		SourceRepository: sourceRepo,
-		CommitID:         commitID,
-		ResourceLabel:    resourceLabel,
+		APIResources:       NewCollection(resourceLabel, client),
+		SourceRepository:   sourceRepo,
+		CommitID:           commitID,
+		ResourceLabel:      resourceLabel,
+		InventoryNamespace: defaultInventoryNamespace,
+		HookDeletePolicy:   HookBeforeCreation,
+		HealthTimeout:      defaultHealthTimeout,
+		client:             client,
 	}
 }
 
@@ -36,61 +73,86 @@ func NewClusterConfig(sourceRepo *sourcerepo.SourceRepo, commitID string) *Clust
 func (cc *ClusterConfig) checkout() error {
 	if err := cc.SourceRepository.Checkout(cc.CommitID); err != nil {
 		log.Printf("checkout of repository failed. Commit: %s", cc.CommitID)
-		return err
+		return &CheckoutError{CommitID: cc.CommitID, Err: err}
 	}
 	return nil
 }
 
 // ApplyManifests applies the manifests stored in the repository
-// and checked out with the commitID.
-// It returns an error if something goes wrong on apply.
+// and checked out with the commitID. The pre-sync hooks are run before
+// and the post-sync hooks after all resources are applied and healthy.
+// The result of each resource is recorded.
+// It returns an error if a resource fails to apply, a pre-sync hook fails
+// or the resources don't become healthy.
 func (cc *ClusterConfig) ApplyManifests() error {
-	if err := cc.checkout(); err != nil {
+	return cc.ApplyManifestsContext(context.Background())
+}
+
+// ApplyManifestsContext applies the manifests like ApplyManifests.
+// Canceling the context stops waiting for resources and hooks.
+func (cc *ClusterConfig) ApplyManifestsContext(ctx context.Context) error {
+	if err := cc.LoadManifests(); err != nil {
 		return err
 	}
+	cc.Waves = cc.APIResources.Waves()
 
-	walkPath := cc.SourceRepository.Directory
-	return filepath.Walk(walkPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
-			return err
-		}
+	if err := cc.APIResources.runHooks(ctx, PreSync, cc.HookDeletePolicy, cc.ApplyOptions); err != nil {
+		log.Printf("Error running hooks of commit %s: %v", cc.CommitID, err)
+		return err
+	}
 
-		// if it is a directory, apply the manifests
-		if info.IsDir() {
-			files, err := ioutil.ReadDir(path)
-			if err != nil {
-				log.Printf("error reading directory: %q: %v\n", path, err)
-				return nil
-			}
+	cc.APIResources.backup = cc.Backup
+	cc.applied = true
+	results, errs := cc.APIResources.apply(ctx, cc.ApplyOptions)
+	cc.Results = results
+	log.Printf("Applied commit %s: %s", cc.CommitID, summarize(results))
+	for _, err := range errs {
+		log.Printf("Error applying resource %v", err)
+	}
+	if len(errs) > 0 {
+		log.Printf("Skip %s hooks of commit %s after failed resources", PostSync, cc.CommitID)
+		return &ApplyError{CommitID: cc.CommitID, Errors: errs}
+	}
 
-			// check if it contains YAML files
-			var containsYAML = false
-			for _, file := range files {
-				matched, _ := filepath.Match("*.yaml", file.Name())
-				containsYAML = containsYAML || matched
-				if matched {
-					break
-				}
-			}
+	if err := cc.assessHealth(ctx); err != nil {
+		log.Printf("Error: resources of commit %s not healthy: %v", cc.CommitID, err)
+		return err
+	}
 
-			if containsYAML {
-				commandArguments := []string{
-					"apply",
-					"-f",
-					path + "/",
-				}
+	if err := cc.APIResources.runHooks(ctx, PostSync, cc.HookDeletePolicy, cc.ApplyOptions); err != nil {
+		log.Printf("Error running hooks of commit %s: %v", cc.CommitID, err)
+	}
+	return nil
+}
 
-				if err := exec.Command("kubectl", commandArguments...).Run(); err != nil {
-					log.Println("Error running command: kubectl ", commandArguments)
-					return nil
-				}
+// summarize returns the number of resources per action of the results
+func summarize(results []*ApplyResult) string {
+	counts := make(map[ApplyAction]int)
+	for _, result := range results {
+		counts[result.Action]++
+	}
 
-				log.Println("Running command: kubectl ", commandArguments)
-			}
+	var summary []string
+	for _, action := range []ApplyAction{Created, Updated, Replaced, Unchanged, Failed, Skipped} {
+		if counts[action] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[action], action))
 		}
-		return nil
-	})
+	}
+	return strings.Join(summary, ", ")
+}
+
+// assessHealth waits for the resources of the ClusterConfig to become healthy
+// and records their health
+// It returns an error if not all resources are healthy.
+func (cc *ClusterConfig) assessHealth(ctx context.Context) error {
+	var resources []*APIResource
+	for _, checksum := range cc.APIResources.sorted() {
+		resources = append(resources, cc.APIResources.Items[checksum])
+	}
+
+	health, err := assessHealth(ctx, cc.client, resources, cc.APIResources.healthTimeout)
+	cc.Health = health
+	return err
 }
 
 // LoadManifests loads the manifests of the checked out repository
@@ -99,67 +161,184 @@ func (cc *ClusterConfig) LoadManifests() error {
 	if err := cc.checkout(); err != nil {
 		return err
 	}
+	if cc.HealthTimeout > 0 {
+		cc.APIResources.healthTimeout = cc.HealthTimeout
+	}
+	cc.APIResources.replaceOnConflict = cc.ReplaceOnConflict
 	return cc.APIResources.LoadFromDirectory(cc.SourceRepository.Directory)
 }
 
 // Label labels all resources of this ClusterConfig in the Cluster
+// as owned by its source and annotates them with the source URL,
+// the path of their manifest and the commit id.
 func (cc *ClusterConfig) Label() {
-	cc.APIResources.Label()
+	cc.APIResources.Label(map[string]string{
+		sourceAnnotation: cc.SourceRepository.URL,
+		commitAnnotation: cc.CommitID,
+	})
 	return
 }
 
 // Clean cleans the cluster from resources which are not in the ClusterConfig,
-// but managed by Kitops
+// but managed by Kitops. Afterwards the inventory of the source is replaced
+// by the resources of the ClusterConfig and the ones left in the cluster.
+// The live objects are saved in the Backup before they are deleted.
+// Resources annotated with kitops.io/prune: "false" are left in the cluster
+// and are no longer managed. The cleanup is aborted if it exceeds the limits
+// of the PruneOptions.
 func (cc *ClusterConfig) Clean() {
-	tempCollection := NewCollection(cc.ResourceLabel)
-	clusterkinds := kinds.getAll()
+	managed, err := cc.managed()
+	if err != nil {
+		log.Printf("Error getting managed resources: %v", err)
+		return
+	}
 
-	// get all labelled resources, put them in a temporary collection
-	for kind, namespaced := range clusterkinds {
-		var commandArguments []string
-		if namespaced {
-			commandArguments = []string{
-				"get",
-				kind,
-				"-l",
-				cc.ResourceLabel,
-				"-o",
-				"yaml",
-				"-A",
+	prunable := cc.prunable(managed)
+	remaining := prunable
+	if err := cc.PruneOptions.check(len(prunable), len(managed.Items)); err != nil {
+		cc.PruneAborted = err.Error()
+		log.Printf("Alert: cleanup of commit %s aborted: %v", cc.CommitID, err)
+	} else {
+		remaining = nil
+		for _, item := range prunable {
+			if live, err := cc.client.Get(item); err == nil {
+				if err := cc.Backup.Save(live); err != nil {
+					log.Printf("Error backing up resource Kind: %s Name: %s Namespace: %s, skip pruning: %v", item.Kind, item.Metadata.Name, item.Metadata.Namespace, err)
+					remaining = append(remaining, item)
+					continue
+				}
 			}
-		} else {
-			commandArguments = []string{
-				"get",
-				kind,
-				"-l",
-				cc.ResourceLabel,
-				"-o",
-				"yaml",
+			if err := item.Delete(cc.client, DeleteOptions{Propagation: cc.PruneOptions.Propagation}); err != nil {
+				remaining = append(remaining, item)
+				continue
 			}
+			cc.Pruned = append(cc.Pruned, item)
 		}
+	}
 
-		list, err := exec.Command("kubectl", commandArguments...).Output()
-		if err != nil {
-			//log.Println("Error running command: kubectl ", commandArguments)
-			continue
-		}
+	cc.saveInventory(remaining)
+	return
+}
 
-		err = tempCollection.LoadFromList(list)
-		if err != nil {
-			log.Println("Error loading API resources from list.")
-			continue
+// Track adds the resources of the ClusterConfig to the inventory and labels them
+// without cleaning up the managed ones. It keeps track of the resources applied
+// by a failed commit. Nothing is done if no resources were applied.
+func (cc *ClusterConfig) Track() {
+	if !cc.applied {
+		return
+	}
+	cc.Label()
+
+	managed, err := cc.managed()
+	if err != nil {
+		log.Printf("Error getting managed resources: %v", err)
+		return
+	}
+
+	var remaining []*APIResource
+	for hash, item := range managed.Items {
+		if _, ok := cc.APIResources.Items[hash]; !ok {
+			remaining = append(remaining, item)
 		}
 	}
+	cc.saveInventory(remaining)
+}
+
+// saveInventory replaces the inventory of the source by the resources
+// of the ClusterConfig and the remaining ones
+func (cc *ClusterConfig) saveInventory(remaining []*APIResource) {
+	inventory := &Inventory{
+		Source:    cc.SourceRepository.URL,
+		CommitID:  cc.CommitID,
+		Resources: remaining,
+	}
+	for _, checksum := range cc.APIResources.order {
+		inventory.Resources = append(inventory.Resources, cc.APIResources.Items[checksum])
+	}
+	if err := inventory.save(cc.client, cc.InventoryNamespace); err != nil {
+		log.Printf("Error saving inventory of commit %s: %v", cc.CommitID, err)
+	}
+}
 
+// prunable returns the managed resources, which are not in the ClusterConfig
+// and not protected from pruning
+func (cc *ClusterConfig) prunable(managed *Collection) []*APIResource {
 	// compare them with the resources of the current ClusterConfig
-	// if not in the current ClusterConfig, delete it
-	for hash, item := range tempCollection.Items {
+	// if not in the current ClusterConfig, it is prunable
+	var prunable []*APIResource
+	for hash, item := range managed.Items {
 		log.Printf("Cleanup check for Checksum: %s %s %s %s", hash, item.Kind, item.Metadata.Name, item.Metadata.Namespace)
-		_, ok := cc.APIResources.Items[hash]
-		if !ok {
-			item.Delete()
+		if _, ok := cc.APIResources.Items[hash]; ok {
+			continue
 		}
+		if cc.APIResources.isHook(hash) {
+			continue
+		}
+		if protected(cc.client, item) {
+			log.Printf("Skip pruning of protected resource Kind: %s Name: %s Namespace: %s", item.Kind, item.Metadata.Name, item.Metadata.Namespace)
+			continue
+		}
+		prunable = append(prunable, item)
 	}
 
-	return
+	return prunable
+}
+
+// managed returns the resources managed by Kitops for the source of the ClusterConfig.
+// They are read from the inventory, or from the labelled resources in the cluster
+// if there is no inventory yet.
+func (cc *ClusterConfig) managed() (*Collection, error) {
+	inventory, err := loadInventory(cc.client, cc.InventoryNamespace, cc.SourceRepository.URL)
+	if errors.IsNotFound(err) {
+		log.Printf("No inventory found for %s, scanning the cluster", cc.SourceRepository.URL)
+		return cc.scan(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	managed := NewCollection(cc.ResourceLabel, cc.client)
+	for _, resource := range inventory.Resources {
+		managed.Items[resource.Checksum()] = resource
+	}
+	return managed, nil
+}
+
+// scan returns the resources in the cluster labelled as managed by Kitops
+// for the source of the ClusterConfig
+func (cc *ClusterConfig) scan() *Collection {
+	tempCollection := NewCollection(cc.ResourceLabel, cc.client)
+	clusterkinds := cc.client.Kinds()
+
+	selectors := []string{cc.ResourceLabel}
+	if legacy := legacyOwnerSelector(cc.SourceRepository.URL); len(legacy) > 0 {
+		selectors = append(selectors, legacy)
+	}
+
+	// get all labelled resources, put them in a temporary collection
+	for _, info := range clusterkinds {
+		if !info.Supports("list") || !info.Supports("delete") {
+			continue
+		}
+
+		for _, selector := range selectors {
+			objects, err := cc.client.List(info, selector)
+			if err != nil {
+				//log.Printf("Error listing %s: %v", info.Resource, err)
+				continue
+			}
+
+			// skip objects of another source with a colliding label
+			var owned []unstructured.Unstructured
+			for _, obj := range objects {
+				if ownedBy(&obj, cc.SourceRepository.URL) {
+					owned = append(owned, obj)
+				}
+			}
+
+			tempCollection.LoadFromObjects(owned)
+		}
+	}
+
+	return tempCollection
 }
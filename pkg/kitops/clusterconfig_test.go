@@ -0,0 +1,719 @@
+package kitops_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/300481/kitops/pkg/kitops"
+	"github.com/300481/kitops/pkg/sourcerepo"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func init() {
+	// serve local repositories without the git binaries
+	client.InstallProtocol("file", server.DefaultServer)
+}
+
+const (
+	testURL = "https://github.com/300481/kitops-test.git"
+
+	namespaceManifest = `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: test
+`
+	appManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: test
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+  namespace: test
+`
+	configManifest = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`
+)
+
+// degradedManifest is the appManifest with a Deployment failed to progress
+var degradedManifest = strings.Replace(appManifest, "replicas: 1\n", `replicas: 1
+status:
+  conditions:
+  - type: Progressing
+    status: "False"
+`, 1)
+
+// newTestRepo returns a clone of a local repository with a commit per manifests map
+// and the commitIDs in the order of the commits
+func newTestRepo(t *testing.T, commits ...map[string]string) (*sourcerepo.SourceRepo, []string) {
+	origin, err := ioutil.TempDir("", "kitops-origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(origin) })
+
+	r, err := git.PlainInit(origin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the repository is only found by the server with a config
+	cfg, err := r.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var commitIDs []string
+	previous := map[string]string{}
+	for _, manifests := range commits {
+		for path := range previous {
+			if _, ok := manifests[path]; !ok {
+				if _, err := wt.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for path, manifest := range manifests {
+			if err := ioutil.WriteFile(filepath.Join(origin, path), []byte(manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash, err := wt.Commit("test", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitIDs = append(commitIDs, hash.String())
+		previous = manifests
+	}
+
+	directory, err := ioutil.TempDir("", "kitops-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	repo, err := sourcerepo.New("file://"+filepath.Join(origin, ".git"), directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, commitIDs
+}
+
+// deploy applies, labels and cleans the manifests like the QueueProcessor
+func deploy(t *testing.T, cluster kitops.ClusterClient, commitID string, manifests map[string]string) *kitops.ClusterConfig {
+	return deployFrom(t, cluster, testURL, commitID, manifests)
+}
+
+// deployFrom deploys the manifests of the source URL
+func deployFrom(t *testing.T, cluster kitops.ClusterClient, url string, commitID string, manifests map[string]string) *kitops.ClusterConfig {
+	cc := kitops.NewClusterConfig(&sourcerepo.SourceRepo{URL: url}, commitID, cluster)
+	for path, manifest := range manifests {
+		if err := cc.APIResources.AddFromFile([]byte(manifest), path); err != nil {
+			t.Fatalf("adding manifest %s: %v", path, err)
+		}
+	}
+	cc.APIResources.Apply(kitops.ApplyOptions{})
+	cc.Label()
+	cc.Clean()
+	return cc
+}
+
+// managedObjects returns the objects of the cluster without the inventories
+func managedObjects(cluster *kitops.FakeCluster) []*unstructured.Unstructured {
+	var objects []*unstructured.Unstructured
+	for _, obj := range cluster.Objects() {
+		if obj.GetNamespace() != "kitops" {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
+
+func TestApply(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+	cc := deploy(t, cluster, "1", map[string]string{
+		"namespace.yaml": namespaceManifest,
+		"app.yaml":       appManifest,
+	})
+
+	if got := len(managedObjects(cluster)); got != 3 {
+		t.Errorf("got %d objects, want 3", got)
+	}
+	if !cc.APIResources.Exists() {
+		t.Error("resources of the ClusterConfig don't exist")
+	}
+	for _, obj := range managedObjects(cluster) {
+		if _, ok := obj.GetLabels()["kitops.io/owner"]; !ok {
+			t.Errorf("%s %s is not labelled", obj.GetKind(), obj.GetName())
+		}
+		annotations := obj.GetAnnotations()
+		if annotations["kitops.io/source"] != testURL || annotations["kitops.io/commit"] != "1" {
+			t.Errorf("%s %s got annotations %v", obj.GetKind(), obj.GetName(), annotations)
+		}
+	}
+}
+
+func TestClean(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+	deploy(t, cluster, "1", map[string]string{
+		"namespace.yaml": namespaceManifest,
+		"app.yaml":       appManifest,
+		"config.yaml":    configManifest,
+	})
+	deploy(t, cluster, "2", map[string]string{
+		"namespace.yaml": namespaceManifest,
+		"config.yaml":    configManifest,
+	})
+
+	objects := managedObjects(cluster)
+	if len(objects) != 2 {
+		t.Fatalf("got %d objects, want 2", len(objects))
+	}
+	for _, obj := range objects {
+		if obj.GetName() == "app" {
+			t.Errorf("%s %s was not cleaned up", obj.GetKind(), obj.GetName())
+		}
+	}
+}
+
+func TestCleanUnmanaged(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+	unmanaged := kitops.NewCollection("", cluster)
+	if err := unmanaged.AddFromFile([]byte(configManifest), "config.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	unmanaged.Apply(kitops.ApplyOptions{})
+
+	deploy(t, cluster, "1", map[string]string{"namespace.yaml": namespaceManifest})
+
+	if got := len(managedObjects(cluster)); got != 2 {
+		t.Errorf("got %d objects, want 2", got)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{
+			"namespace.yaml": namespaceManifest,
+			"app.yaml":       appManifest,
+		},
+		map[string]string{
+			"namespace.yaml": namespaceManifest,
+			"config.yaml":    configManifest,
+		},
+	)
+	cluster := kitops.NewFakeCluster()
+
+	cc := kitops.NewClusterConfig(repo, commitIDs[0], cluster)
+	if err := cc.ApplyManifests(); err != nil {
+		t.Fatal(err)
+	}
+	cc.Label()
+
+	plan, err := kitops.NewClusterConfig(repo, commitIDs[1], cluster).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Create) != 1 || plan.Create[0].Kind != "ConfigMap" {
+		t.Errorf("got create %v, want the ConfigMap", plan.Create)
+	}
+	if len(plan.Unchanged) != 1 || plan.Unchanged[0].Kind != "Namespace" {
+		t.Errorf("got unchanged %v, want the Namespace", plan.Unchanged)
+	}
+	if len(plan.Prune) != 2 {
+		t.Errorf("got prune %v, want the Deployment and the Service", plan.Prune)
+	}
+	if got := len(managedObjects(cluster)); got != 3 {
+		t.Errorf("plan changed the cluster: got %d objects, want 3", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{"app.yaml": appManifest},
+		map[string]string{"app.yaml": strings.Replace(appManifest, "replicas: 1", "replicas: 2", 1)},
+	)
+	cluster := kitops.NewFakeCluster()
+
+	if err := kitops.NewClusterConfig(repo, commitIDs[0], cluster).ApplyManifests(); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := kitops.NewClusterConfig(repo, commitIDs[1], cluster).Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rd := range diff.Resources {
+		switch rd.Resource.Kind {
+		case "Deployment":
+			if rd.Action != kitops.Updated || !strings.Contains(rd.Diff, "-  replicas: 1\n+  replicas: 2\n") {
+				t.Errorf("got %s diff:\n%s", rd.Action, rd.Diff)
+			}
+		case "Service":
+			if rd.Action != kitops.Unchanged || len(rd.Diff) != 0 {
+				t.Errorf("got %s diff:\n%s", rd.Action, rd.Diff)
+			}
+		}
+	}
+}
+
+func TestCleanSameKindOfDifferentGroups(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+	cluster.AddKind(schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"}, "certificates", true)
+	cluster.AddKind(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Certificate"}, "certificates", true)
+
+	certificate := `
+apiVersion: %s
+kind: Certificate
+metadata:
+  name: web
+`
+	deploy(t, cluster, "1", map[string]string{
+		"a.yaml": fmt.Sprintf(certificate, "cert-manager.io/v1"),
+		"b.yaml": fmt.Sprintf(certificate, "example.com/v1"),
+	})
+	deploy(t, cluster, "2", map[string]string{
+		"b.yaml": fmt.Sprintf(certificate, "example.com/v1"),
+	})
+
+	objects := managedObjects(cluster)
+	if len(objects) != 1 || objects[0].GetAPIVersion() != "example.com/v1" {
+		t.Errorf("got %d objects, want the Certificate of example.com", len(objects))
+	}
+}
+
+func TestCleanLongURL(t *testing.T) {
+	url := "https://gitlab.example.com/platform-team/cluster-configurations/production-cluster-manifests.git"
+	cluster := kitops.NewFakeCluster()
+	deployFrom(t, cluster, url, "1", map[string]string{
+		"namespace.yaml": namespaceManifest,
+		"config.yaml":    configManifest,
+	})
+	deployFrom(t, cluster, url, "2", map[string]string{
+		"namespace.yaml": namespaceManifest,
+	})
+
+	objects := managedObjects(cluster)
+	if len(objects) != 1 || objects[0].GetKind() != "Namespace" {
+		t.Errorf("got %d objects, want the Namespace", len(objects))
+	}
+}
+
+func TestCleanFromInventory(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+	deploy(t, cluster, "1", map[string]string{
+		"namespace.yaml": namespaceManifest,
+		"config.yaml":    configManifest,
+	})
+
+	// the ConfigMap is only found in the inventory with another owner label
+	var config kitops.APIResource
+	config.APIVersion = "v1"
+	config.Kind = "ConfigMap"
+	config.Metadata.Name = "config"
+	config.Metadata.Namespace = "default"
+	if err := cluster.Label(&config, map[string]string{"kitops.io/owner": "other"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	deploy(t, cluster, "2", map[string]string{
+		"namespace.yaml": namespaceManifest,
+	})
+
+	objects := managedObjects(cluster)
+	if len(objects) != 1 || objects[0].GetKind() != "Namespace" {
+		t.Errorf("got %d objects, want the Namespace", len(objects))
+	}
+}
+
+func TestCleanProtected(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+	deploy(t, cluster, "1", map[string]string{
+		"namespace.yaml": namespaceManifest,
+		"config.yaml":    configManifest,
+	})
+
+	var config kitops.APIResource
+	config.APIVersion = "v1"
+	config.Kind = "ConfigMap"
+	config.Metadata.Name = "config"
+	config.Metadata.Namespace = "default"
+	if err := cluster.Label(&config, nil, map[string]string{"kitops.io/prune": "false"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := deploy(t, cluster, "2", map[string]string{
+		"namespace.yaml": namespaceManifest,
+	})
+
+	if got := len(managedObjects(cluster)); got != 2 {
+		t.Errorf("got %d objects, want 2", got)
+	}
+	if len(cc.Pruned) != 0 {
+		t.Errorf("got pruned %v, want none", cc.Pruned)
+	}
+}
+
+func TestCleanExceedingLimit(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+	deploy(t, cluster, "1", map[string]string{
+		"namespace.yaml": namespaceManifest,
+		"app.yaml":       appManifest,
+		"config.yaml":    configManifest,
+	})
+
+	cc := kitops.NewClusterConfig(&sourcerepo.SourceRepo{URL: testURL}, "2", cluster)
+	cc.PruneOptions = kitops.PruneOptions{MaxPercent: 50}
+	if err := cc.APIResources.AddFromFile([]byte(namespaceManifest), "namespace.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	cc.APIResources.Apply(kitops.ApplyOptions{})
+	cc.Clean()
+
+	if len(cc.PruneAborted) == 0 {
+		t.Error("cleanup of 3 of 4 resources was not aborted")
+	}
+	if got := len(managedObjects(cluster)); got != 4 {
+		t.Errorf("got %d objects, want 4", got)
+	}
+
+	// the resources are kept in the inventory and pruned within the limit
+	cc = kitops.NewClusterConfig(&sourcerepo.SourceRepo{URL: testURL}, "3", cluster)
+	cc.PruneOptions = kitops.PruneOptions{MaxCount: 3}
+	if err := cc.APIResources.AddFromFile([]byte(namespaceManifest), "namespace.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	cc.APIResources.Apply(kitops.ApplyOptions{})
+	cc.Clean()
+
+	if len(cc.PruneAborted) != 0 || len(cc.Pruned) != 3 {
+		t.Errorf("got pruned %v, aborted %q", cc.Pruned, cc.PruneAborted)
+	}
+}
+
+func TestApplyCustomResourceBeforeDefinition(t *testing.T) {
+	repo, commitIDs := newTestRepo(t, map[string]string{
+		"a.yaml": `
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+  namespace: test
+`,
+		"b.yaml": namespaceManifest,
+		"z.yaml": `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  scope: Namespaced
+  names:
+    kind: Widget
+    plural: widgets
+  versions:
+  - name: v1
+    served: true
+    storage: true
+`,
+	})
+	cluster := kitops.NewFakeCluster()
+
+	if err := kitops.NewClusterConfig(repo, commitIDs[0], cluster).ApplyManifests(); err != nil {
+		t.Fatal(err)
+	}
+
+	var widget kitops.APIResource
+	widget.APIVersion = "example.com/v1"
+	widget.Kind = "Widget"
+	widget.Metadata.Name = "widget"
+	widget.Metadata.Namespace = "test"
+	if !widget.Exists(cluster) {
+		t.Error("Widget was not applied after its CustomResourceDefinition")
+	}
+}
+
+func TestApplySyncWaves(t *testing.T) {
+	migration := `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  namespace: test
+  annotations:
+    kitops.io/sync-wave: "-1"
+`
+	failed := migration + `status:
+  conditions:
+  - type: Failed
+    status: "True"
+`
+	for _, tc := range []struct {
+		name      string
+		migration string
+		objects   int
+		skipped   int
+	}{
+		{name: "healthy", migration: migration, objects: 3},
+		{name: "failed", migration: failed, objects: 1, skipped: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, commitIDs := newTestRepo(t, map[string]string{
+				"app.yaml":       appManifest,
+				"migration.yaml": tc.migration,
+			})
+			cluster := kitops.NewFakeCluster()
+
+			cc := kitops.NewClusterConfig(repo, commitIDs[0], cluster)
+			if err := cc.ApplyManifests(); (err != nil) != (tc.skipped > 0) {
+				t.Errorf("got error %v", err)
+			}
+
+			skipped := 0
+			for _, result := range cc.Results {
+				if result.Action == kitops.Skipped {
+					skipped++
+				}
+			}
+			if skipped != tc.skipped {
+				t.Errorf("got %d skipped resources, want %d", skipped, tc.skipped)
+			}
+			if len(cc.Waves) != 2 || cc.Waves[0].Number != -1 || len(cc.Waves[0].Resources) != 1 || len(cc.Waves[1].Resources) != 2 {
+				t.Errorf("got waves %+v, want the Job before the Deployment and the Service", cc.Waves)
+			}
+			if got := len(managedObjects(cluster)); got != tc.objects {
+				t.Errorf("got %d objects, want %d", got, tc.objects)
+			}
+		})
+	}
+}
+
+func TestReplaceOnConflict(t *testing.T) {
+	service := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+  annotations:
+    kitops.io/replace-on-conflict: "%t"
+spec:
+  clusterIP: %s
+`
+	for _, tc := range []struct {
+		name     string
+		annotate bool
+		policy   bool
+		want     string
+	}{
+		{name: "conflict", want: "10.0.0.1"},
+		{name: "annotated", annotate: true, want: "10.0.0.2"},
+		{name: "policy", policy: true, want: "10.0.0.2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, commitIDs := newTestRepo(t,
+				map[string]string{"service.yaml": fmt.Sprintf(service, tc.annotate, "10.0.0.1")},
+				map[string]string{"service.yaml": fmt.Sprintf(service, tc.annotate, "10.0.0.2")},
+			)
+			cluster := kitops.NewFakeCluster()
+
+			if err := kitops.NewClusterConfig(repo, commitIDs[0], cluster).ApplyManifests(); err != nil {
+				t.Fatal(err)
+			}
+
+			cc := kitops.NewClusterConfig(repo, commitIDs[1], cluster)
+			cc.ReplaceOnConflict = tc.policy
+			plan, err := cc.Plan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replace := tc.want == "10.0.0.2"; replace != (len(plan.Replace) == 1) {
+				t.Errorf("got plan to replace %v", plan.Replace)
+			}
+
+			cc = kitops.NewClusterConfig(repo, commitIDs[1], cluster)
+			cc.ReplaceOnConflict = tc.policy
+			if err := cc.ApplyManifests(); (err != nil) != (tc.want == "10.0.0.1") {
+				t.Errorf("got error %v", err)
+			}
+
+			objects := managedObjects(cluster)
+			if len(objects) != 1 {
+				t.Fatalf("got %d objects, want the Service", len(objects))
+			}
+			if got, _, _ := unstructured.NestedString(objects[0].Object, "spec", "clusterIP"); got != tc.want {
+				t.Errorf("got clusterIP %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServerSideApplyConflict(t *testing.T) {
+	scaled := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "app", "namespace": "test"},
+		"spec":       map[string]interface{}{"replicas": int64(3)},
+	}}
+	for _, tc := range []struct {
+		name     string
+		opts     kitops.ApplyOptions
+		conflict bool
+	}{
+		{name: "client-side", opts: kitops.ApplyOptions{}},
+		{name: "server-side", opts: kitops.ApplyOptions{ServerSide: true}, conflict: true},
+		{name: "force", opts: kitops.ApplyOptions{ServerSide: true, Force: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, commitIDs := newTestRepo(t, map[string]string{"app.yaml": appManifest})
+			cluster := kitops.NewFakeCluster()
+
+			cc := kitops.NewClusterConfig(repo, commitIDs[0], cluster)
+			cc.ApplyOptions = kitops.ApplyOptions{ServerSide: true}
+			if err := cc.ApplyManifests(); err != nil {
+				t.Fatal(err)
+			}
+			// another field manager scales the Deployment
+			if err := cluster.ApplyAs("autoscaler", scaled); err != nil {
+				t.Fatal(err)
+			}
+
+			cc = kitops.NewClusterConfig(repo, commitIDs[0], cluster)
+			cc.ApplyOptions = tc.opts
+			err := cc.ApplyManifests()
+			var applyErr *kitops.ApplyError
+			if tc.conflict != errors.As(err, &applyErr) {
+				t.Fatalf("got error %v, want conflict %t", err, tc.conflict)
+			}
+			var statusErr *apierrors.StatusError
+			if tc.conflict && (len(applyErr.Errors) != 1 || !errors.As(applyErr.Errors[0], &statusErr) || !apierrors.IsConflict(statusErr)) {
+				t.Errorf("got errors %v, want the conflict of the Deployment", applyErr.Errors)
+			}
+
+			var deployment *kitops.APIResource
+			for _, result := range cc.Results {
+				if result.Resource.Kind == "Deployment" {
+					deployment = result.Resource
+				}
+				failed := result.Action == kitops.Failed
+				if want := tc.conflict && result.Resource.Kind == "Deployment"; failed != want || failed != (len(result.Error) > 0) {
+					t.Errorf("got %s %s with error %q", result.Resource.Kind, result.Action, result.Error)
+				}
+			}
+
+			want := int64(1)
+			if tc.conflict {
+				want = 3
+			}
+			live, err := cluster.Get(deployment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _, _ := unstructured.NestedInt64(live.Object, "spec", "replicas"); got != want {
+				t.Errorf("got %d replicas, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyResults(t *testing.T) {
+	repo, commitIDs := newTestRepo(t, map[string]string{
+		"app.yaml": appManifest,
+		"unknown.yaml": `
+apiVersion: example.com/v1
+kind: Unknown
+metadata:
+  name: unknown
+`,
+	})
+	cluster := kitops.NewFakeCluster()
+
+	cc := kitops.NewClusterConfig(repo, commitIDs[0], cluster)
+	if err := cc.ApplyManifests(); err == nil {
+		t.Error("got no error applying an unknown Kind")
+	}
+
+	actions := map[string]kitops.ApplyAction{}
+	for _, result := range cc.Results {
+		actions[result.Resource.Kind] = result.Action
+		if result.Action == kitops.Failed && len(result.Error) == 0 {
+			t.Errorf("got no error message of the failed %s", result.Resource.Kind)
+		}
+	}
+	want := map[string]kitops.ApplyAction{"Deployment": kitops.Created, "Service": kitops.Created, "Unknown": kitops.Failed}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("got results %v, want %v", actions, want)
+	}
+}
+
+func TestApplyDefaulted(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+	service := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "app", "namespace": "test"},
+		"spec": map[string]interface{}{
+			"ports": []interface{}{map[string]interface{}{"port": int64(80)}},
+		},
+	}}
+
+	if _, action, err := cluster.Apply(service, kitops.ApplyOptions{}); err != nil || action != kitops.Created {
+		t.Fatalf("got %s %v, want the Service created", action, err)
+	}
+	live, action, err := cluster.Apply(service, kitops.ApplyOptions{})
+	if err != nil || action != kitops.Unchanged {
+		t.Errorf("got %s %v applying the Service again, want it unchanged", action, err)
+	}
+	ports, _, _ := unstructured.NestedSlice(live.Object, "spec", "ports")
+	if len(ports) != 1 || ports[0].(map[string]interface{})["protocol"] != "TCP" {
+		t.Errorf("got ports %v, want the defaulted protocol kept", ports)
+	}
+
+	unstructured.SetNestedSlice(service.Object, []interface{}{
+		map[string]interface{}{"port": int64(80), "name": "http"},
+	}, "spec", "ports")
+	live, action, err = cluster.Apply(service, kitops.ApplyOptions{})
+	if err != nil || action != kitops.Updated {
+		t.Errorf("got %s %v applying the changed Service, want it updated", action, err)
+	}
+	ports, _, _ = unstructured.NestedSlice(live.Object, "spec", "ports")
+	if len(ports) != 1 || ports[0].(map[string]interface{})["name"] != "http" || ports[0].(map[string]interface{})["protocol"] != "TCP" {
+		t.Errorf("got ports %v, want the named port with the defaulted protocol", ports)
+	}
+}
@@ -1,56 +1,69 @@
 package kitops
 
-// namespaced struct holds the dynamic information if Kind is Namespaced
 import (
 	"log"
-	"os/exec"
 	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
 )
 
-// clusterKinds holds the namespaced information for Kitops
+// clusterKinds holds the API information of all Kinds of the cluster
 type clusterKinds struct {
-	isNamespaced map[string]bool
+	discovery discovery.CachedDiscoveryInterface
+	kinds     map[schema.GroupKind]KindInfo
 }
 
-// declare package variable
-var kinds *clusterKinds
-
-// getAll returns the isNamespaced map
-func (ck *clusterKinds) getAll() map[string]bool {
-	return ck.isNamespaced
+// newClusterKinds returns an initialized *clusterKinds
+func newClusterKinds(d discovery.CachedDiscoveryInterface) *clusterKinds {
+	return &clusterKinds{
+		discovery: d,
+		kinds:     make(map[schema.GroupKind]KindInfo),
+	}
 }
 
-// namespaced returns a bool if the Kind is namespaced or not
-func (ck *clusterKinds) namespaced(kind string) bool {
+// getAll returns the API information of all Kinds
+// freshly discovered from the cluster
+func (ck *clusterKinds) getAll() map[schema.GroupKind]KindInfo {
+	ck.discovery.Invalidate()
 	ck.update()
-	return ck.isNamespaced[kind]
+	return ck.kinds
 }
 
-// update updates the namespaced information for Kitops
+// update updates the API information with the preferred versions of the cluster
 func (ck *clusterKinds) update() {
-	output, err := exec.Command("kubectl", "api-resources").Output()
+	lists, err := ck.discovery.ServerPreferredResources()
 	if err != nil {
+		// partial results are returned if some API groups are unavailable
 		log.Println(err)
-		return
 	}
 
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines[1:] {
-		if len(line) == 0 {
-			break
+	kinds := make(map[schema.GroupKind]KindInfo)
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
 
-		s := strings.Fields(line)
-		kind := s[len(s)-1]
-		namespaced := s[len(s)-2] == "true"
-
-		ck.isNamespaced[kind] = namespaced
+		for _, resource := range list.APIResources {
+			// skip subresources like deployments/scale
+			if strings.Contains(resource.Name, "/") {
+				continue
+			}
+			gk := gv.WithKind(resource.Kind).GroupKind()
+			if _, ok := kinds[gk]; ok {
+				continue
+			}
+			kinds[gk] = KindInfo{
+				Resource:   gv.WithResource(resource.Name),
+				Namespaced: resource.Namespaced,
+				Verbs:      resource.Verbs,
+			}
+		}
 	}
-}
 
-// initialize namespaced
-func init() {
-	kinds = &clusterKinds{
-		isNamespaced: make(map[string]bool),
+	if len(kinds) > 0 {
+		ck.kinds = kinds
 	}
 }
@@ -1,14 +1,17 @@
 package kitops
 
 import (
-	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
-	yaml "gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
@@ -21,19 +24,37 @@ type Collection struct {
 	Items         map[string]*APIResource
 	manifests     map[string][]byte
 	ResourceLabel string
+	objects       map[string]*unstructured.Unstructured
+	paths         map[string]string
+	order         []string
+	client        ClusterClient
+	// backup stores the live objects before they are updated
+	backup *Backup
+	// hooks are run before and after applying the objects
+	hooks []*hook
+	// healthTimeout is the time to wait for applied objects to become healthy
+	healthTimeout time.Duration
+	// replaceOnConflict replaces all objects failing with changed immutable fields
+	replaceOnConflict bool
 }
 
 // NewCollection returns an empty collection of API resources
-func NewCollection(label string) *Collection {
+// client is the client of the cluster holding the resources
+func NewCollection(label string, client ClusterClient) *Collection {
 	return &Collection{
 		Items:         make(map[string]*APIResource),
 		manifests:     make(map[string][]byte),
 		ResourceLabel: label,
+		objects:       make(map[string]*unstructured.Unstructured),
+		paths:         make(map[string]string),
+		client:        client,
+		healthTimeout: defaultHealthTimeout,
 	}
 }
 
 // LoadFromDirectory loads collections from YAML files
 // within the directory recursively
+// The manifests are added with their path relative to the directory.
 // returns an error if something is wrong with the files
 func (c *Collection) LoadFromDirectory(directory string) error {
 	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
@@ -55,7 +76,13 @@ func (c *Collection) LoadFromDirectory(directory string) error {
 				return nil
 			}
 
-			if err := c.AddFromFile(manifest, path); err != nil {
+			relativePath, err := filepath.Rel(directory, path)
+			if err != nil {
+				log.Printf("error getting relative path of %q: %v\n", path, err)
+				return nil
+			}
+
+			if err := c.AddFromFile(manifest, relativePath); err != nil {
 				log.Printf("error adding manifest: %v\n", err)
 				return nil
 			}
@@ -65,6 +92,7 @@ func (c *Collection) LoadFromDirectory(directory string) error {
 }
 
 // AddFromFile adds API Resources from the given manifest
+// Hooks are kept apart from the resources.
 // manifest is a byte array containing the manifest
 // path is the path of the manifest file
 // returns an error if the manifest is invalid
@@ -73,58 +101,62 @@ func (c *Collection) AddFromFile(manifest []byte, path string) error {
 		return errors.New(errInvalidYaml)
 	}
 
+	objects, err := decodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+
 	c.manifests[path] = make([]byte, len(manifest))
 	copy(c.manifests[path], manifest)
 
-	APIResourceContentReader := bytes.NewReader(c.manifests[path])
-	for {
-		resource, err := NewResource(APIResourceContentReader)
+	for _, obj := range objects {
+		h, err := newHook(obj)
 		if err != nil {
-			break
+			log.Printf("Error adding hook from %s: %v", path, err)
+			continue
 		}
-		c.Items[resource.Checksum()] = resource
+		if h != nil {
+			c.addHook(h)
+			continue
+		}
+
+		resource := newResourceFromObject(obj)
+		checksum := resource.Checksum()
+		if _, ok := c.objects[checksum]; !ok {
+			c.order = append(c.order, checksum)
+		}
+		c.Items[checksum] = resource
+		c.objects[checksum] = obj
+		c.paths[checksum] = path
 		log.Printf("Add Resource #%d from File to Collection %s %s %s %s", len(c.Items), resource.Checksum(), resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace)
 	}
 
 	return nil
 }
 
-// List holds the returned resources from kubectl get
-type List struct {
-	Kind  string
-	Items []APIResource
-}
-
-// LoadFromList loads API Resources from a byte array
-// with a List of API Resources
-func (c *Collection) LoadFromList(listContent []byte) error {
-	listContentReader := bytes.NewReader(listContent)
-	dec := yaml.NewDecoder(listContentReader)
-
-	var list List
-	err := dec.Decode(&list)
-	if err != nil {
-		log.Println("Error loading resources from list of kubectl")
-		return err
-	}
-
-	if list.Kind != "List" {
-		return errors.New("Error: got no list from kubectl")
+// addHook adds the hook replacing one of the same resource
+func (c *Collection) addHook(h *hook) {
+	for i, existing := range c.hooks {
+		if existing.resource.Checksum() == h.resource.Checksum() {
+			c.hooks[i] = h
+			return
+		}
 	}
+	c.hooks = append(c.hooks, h)
+	log.Printf("Add %s hook to Collection %s %s %s", h.phase, h.resource.Kind, h.resource.Metadata.Name, h.resource.Metadata.Namespace)
+}
 
-	for _, resource := range list.Items {
+// LoadFromObjects loads API Resources from objects
+// read from the cluster
+func (c *Collection) LoadFromObjects(objects []unstructured.Unstructured) {
+	for i := range objects {
+		resource := newResourceFromObject(&objects[i])
 		if c.invalidKind(resource.Kind) {
 			continue
 		}
-		if len(resource.Metadata.Namespace) == 0 {
-			resource.Metadata.Namespace = "default"
-		}
-		ar := resource
-		c.Items[resource.Checksum()] = &ar
+		c.Items[resource.Checksum()] = resource
 		log.Printf("Add Resource #%d from List to Collection %s %s %s %s", len(c.Items), resource.Checksum(), resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace)
 	}
-
-	return nil
 }
 
 // Exists returns a bool. true if the resources exists in the cluster, false if not
@@ -132,15 +164,137 @@ func (c *Collection) LoadFromList(listContent []byte) error {
 func (c *Collection) Exists() bool {
 	var b = true
 	for _, resource := range c.Items {
-		b = b && resource.Exists()
+		b = b && resource.Exists(c.client)
 	}
 	return b
 }
 
+// Apply applies all objects loaded from manifests to the cluster
+// wave by wave and ordered by Kind with the given options
+func (c *Collection) Apply(opts ApplyOptions) {
+	_, errs := c.apply(context.Background(), opts)
+	for _, err := range errs {
+		log.Printf("Error applying resource %v", err)
+	}
+}
+
+// apply applies all objects wave by wave with the given options.
+// Before applying the next wave, the resources of the previous one
+// have to be applied and healthy, otherwise the following waves are skipped.
+// returns the result of each resource in the order of applying and all errors
+func (c *Collection) apply(ctx context.Context, opts ApplyOptions) ([]*ApplyResult, []error) {
+	var results []*ApplyResult
+	var errs []error
+
+	numbers, waves := c.waves()
+	for i, number := range numbers {
+		waveResults, waveErrs := c.applyWave(ctx, waves[number], opts)
+		results = append(results, waveResults...)
+		errs = append(errs, waveErrs...)
+		if opts.DryRun || i == len(numbers)-1 {
+			continue
+		}
+
+		if len(waveErrs) == 0 {
+			log.Printf("Wait for sync wave %d to be healthy", number)
+			var applied []*APIResource
+			for _, result := range waveResults {
+				applied = append(applied, result.Resource)
+			}
+			if err := waitForHealthy(ctx, c.client, applied, c.healthTimeout); err != nil {
+				waveErrs = append(waveErrs, err)
+				errs = append(errs, fmt.Errorf("sync wave %d: %w", number, err))
+			}
+		}
+		if len(waveErrs) > 0 {
+			errs = append(errs, fmt.Errorf("sync wave %d failed, skip applying sync waves after it", number))
+			for _, skipped := range numbers[i+1:] {
+				for _, checksum := range waves[skipped] {
+					results = append(results, &ApplyResult{
+						Resource: c.Items[checksum],
+						Action:   Skipped,
+						Error:    fmt.Sprintf("sync wave %d failed", number),
+					})
+				}
+			}
+			break
+		}
+	}
+	return results, errs
+}
+
+// applyWave applies the objects of the checksums ordered by Kind with the given options
+// and saves the live objects in the backup before they are updated.
+// Objects failing with changed immutable fields are replaced, if allowed.
+// Objects following CustomResourceDefinitions are applied after they are established.
+// returns the result of each resource and the errors
+func (c *Collection) applyWave(ctx context.Context, checksums []string, opts ApplyOptions) ([]*ApplyResult, []error) {
+	var results []*ApplyResult
+	var errs []error
+	var crds []*APIResource
+	for _, checksum := range checksums {
+		resource := c.Items[checksum]
+
+		if len(crds) > 0 && resource.Kind != crdKind {
+			for _, crd := range crds {
+				if err := waitForEstablished(ctx, c.client, crd, crdTimeout); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			crds = nil
+		}
+
+		// keep the live object for the backup before it is updated
+		var live *unstructured.Unstructured
+		if c.backup != nil && !opts.DryRun {
+			live, _ = c.client.Get(resource)
+		}
+
+		_, action, err := c.client.Apply(c.objects[checksum], opts)
+		if err != nil && immutableFieldError(err) && c.replaceable(checksum) {
+			action, err = c.replace(ctx, checksum, opts)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Kind: %s Name: %s Namespace: %s: %w", resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace, err))
+			results = append(results, &ApplyResult{Resource: resource, Action: Failed, Error: err.Error()})
+			continue
+		}
+		if action == Updated || action == Replaced {
+			if err := c.backup.Save(live); err != nil {
+				log.Printf("Error backing up resource Kind: %s Name: %s Namespace: %s: %v", resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace, err)
+			}
+		}
+		results = append(results, &ApplyResult{Resource: resource, Action: action})
+		if resource.Kind == crdKind && !opts.DryRun {
+			crds = append(crds, resource)
+		}
+		if !opts.DryRun {
+			log.Printf("Apply Resource %s Kind: %s Name: %s Namespace: %s", action, resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace)
+		}
+	}
+	return results, errs
+}
+
 // Label labels all resources of the collection in the cluster
-func (c *Collection) Label() {
-	for _, resource := range c.Items {
-		resource.Label(c.ResourceLabel)
+// with the ResourceLabel and the annotations. The resources loaded
+// from manifests are annotated with the path of their manifest.
+func (c *Collection) Label(annotations map[string]string) {
+	resourceLabels, err := labels.ConvertSelectorToLabelsMap(c.ResourceLabel)
+	if err != nil {
+		log.Printf("Error: invalid label %q: %v", c.ResourceLabel, err)
+		return
+	}
+
+	for checksum, resource := range c.Items {
+		resourceAnnotations := make(map[string]string, len(annotations)+1)
+		for k, v := range annotations {
+			resourceAnnotations[k] = v
+		}
+		if path, ok := c.paths[checksum]; ok {
+			resourceAnnotations[pathAnnotation] = path
+		}
+
+		resource.Label(c.client, resourceLabels, resourceAnnotations)
 	}
 }
 
@@ -0,0 +1,134 @@
+package kitops
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// Diff holds the differences between the manifests of a commit and the cluster
+type Diff struct {
+	CommitID  string
+	Resources []*ResourceDiff
+	Errors    []string
+}
+
+// ResourceDiff holds the differences of a resource between
+// the live object and the object after applying the manifest
+type ResourceDiff struct {
+	Resource *APIResource
+	Action   ApplyAction
+	Diff     string
+}
+
+// String returns the unified diffs of all changed resources
+func (d *Diff) String() string {
+	var sb strings.Builder
+	for _, rd := range d.Resources {
+		sb.WriteString(rd.Diff)
+	}
+	return sb.String()
+}
+
+// Diff loads the manifests of the ClusterConfig and returns the differences
+// to the live objects, without changing the cluster.
+// It returns an error if the manifests can't be loaded.
+func (cc *ClusterConfig) Diff() (*Diff, error) {
+	if err := cc.LoadManifests(); err != nil {
+		return nil, err
+	}
+
+	diff := &Diff{CommitID: cc.CommitID}
+	for _, checksum := range cc.APIResources.sorted() {
+		resource := cc.APIResources.Items[checksum]
+
+		rd, err := cc.APIResources.diff(checksum, cc.ApplyOptions)
+		if err != nil {
+			diff.Errors = append(diff.Errors, fmt.Sprintf("Kind: %s Name: %s Namespace: %s: %v", resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace, err))
+			continue
+		}
+		diff.Resources = append(diff.Resources, rd)
+	}
+
+	return diff, nil
+}
+
+// diff returns the differences of the object with the checksum
+// between the cluster and a dry run of applying it with the options
+func (c *Collection) diff(checksum string, opts ApplyOptions) (*ResourceDiff, error) {
+	resource := c.Items[checksum]
+
+	live, err := c.client.Get(resource)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	opts.DryRun = true
+	merged, action, err := c.client.Apply(c.objects[checksum], opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := &ResourceDiff{
+		Resource: resource,
+		Action:   action,
+	}
+	if action == Unchanged {
+		return rd, nil
+	}
+
+	liveYAML, err := normalizedYAML(live)
+	if err != nil {
+		return nil, err
+	}
+	mergedYAML, err := normalizedYAML(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.Join([]string{resource.APIVersion, resource.Kind, resource.Metadata.Namespace, resource.Metadata.Name}, "/")
+	rd.Diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(liveYAML),
+		B:        difflib.SplitLines(mergedYAML),
+		FromFile: "live/" + name,
+		ToFile:   "merged/" + name,
+		Context:  3,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rd, nil
+}
+
+// normalizedYAML returns the object as YAML without the fields populated by
+// the API server. It returns an empty string for a nil object.
+func normalizedYAML(obj *unstructured.Unstructured) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+
+	obj = obj.DeepCopy()
+	for _, field := range []string{"uid", "resourceVersion", "generation", "creationTimestamp", "managedFields", "selfLink"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(obj.Object, "status")
+
+	annotations := obj.GetAnnotations()
+	delete(annotations, lastAppliedAnnotation)
+	if len(annotations) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+	} else {
+		obj.SetAnnotations(annotations)
+	}
+
+	b, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
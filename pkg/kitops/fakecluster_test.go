@@ -0,0 +1,547 @@
+package kitops
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// immutableFields are the fields of the Kinds, which can't be changed once set
+var immutableFields = map[string][][]string{
+	"Job":     {{"spec", "selector"}, {"spec", "template"}},
+	"Service": {{"spec", "clusterIP"}},
+}
+
+// fakeKey identifies an object in the FakeCluster
+type fakeKey struct {
+	group     string
+	kind      string
+	namespace string
+	name      string
+}
+
+// FakeCluster is an in-memory ClusterClient to test kitops without a cluster
+type FakeCluster struct {
+	mux     sync.Mutex
+	kinds   map[schema.GroupKind]KindInfo
+	objects map[fakeKey]*unstructured.Unstructured
+	// managers holds the field manager of each field path of the objects
+	managers map[fakeKey]map[string]string
+}
+
+// NewFakeCluster returns an empty *FakeCluster
+// serving the core Kinds used in most manifests.
+// Applied CustomResourceDefinitions are established immediately.
+func NewFakeCluster() *FakeCluster {
+	fc := &FakeCluster{
+		kinds:    make(map[schema.GroupKind]KindInfo),
+		objects:  make(map[fakeKey]*unstructured.Unstructured),
+		managers: make(map[fakeKey]map[string]string),
+	}
+
+	fc.AddKind(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, "namespaces", false)
+	fc.AddKind(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, "configmaps", true)
+	fc.AddKind(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, "secrets", true)
+	fc.AddKind(schema.GroupVersionKind{Version: "v1", Kind: "Service"}, "services", true)
+	fc.AddKind(schema.GroupVersionKind{Version: "v1", Kind: "ServiceAccount"}, "serviceaccounts", true)
+	fc.AddKind(schema.GroupVersionKind{Version: "v1", Kind: "PersistentVolumeClaim"}, "persistentvolumeclaims", true)
+	fc.AddKind(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, "pods", true)
+	fc.AddKind(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, "deployments", true)
+	fc.AddKind(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}, "statefulsets", true)
+	fc.AddKind(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"}, "daemonsets", true)
+	fc.AddKind(schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, "jobs", true)
+	fc.AddKind(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: crdKind}, "customresourcedefinitions", false)
+
+	return fc
+}
+
+// AddKind makes the Kind known to the FakeCluster
+// resource is the plural resource name of the Kind
+func (fc *FakeCluster) AddKind(gvk schema.GroupVersionKind, resource string, namespaced bool) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	fc.addKind(gvk, resource, namespaced)
+}
+
+// addKind makes the Kind known to the FakeCluster without locking it
+func (fc *FakeCluster) addKind(gvk schema.GroupVersionKind, resource string, namespaced bool) {
+	fc.kinds[gvk.GroupKind()] = KindInfo{
+		Resource:   gvk.GroupVersion().WithResource(resource),
+		Namespaced: namespaced,
+		Verbs:      []string{"get", "list", "create", "update", "patch", "delete"},
+	}
+}
+
+// Objects returns copies of all objects in the FakeCluster
+// sorted by group, kind, namespace and name
+func (fc *FakeCluster) Objects() []*unstructured.Unstructured {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	keys := make([]fakeKey, 0, len(fc.objects))
+	for key := range fc.objects {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+
+	objects := make([]*unstructured.Unstructured, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, fc.objects[key].DeepCopy())
+	}
+	return objects
+}
+
+// Kinds returns the API information of all Kinds of the FakeCluster
+func (fc *FakeCluster) Kinds() map[schema.GroupKind]KindInfo {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	kinds := make(map[schema.GroupKind]KindInfo, len(fc.kinds))
+	for kind, info := range fc.kinds {
+		kinds[kind] = info
+	}
+	return kinds
+}
+
+// Get returns a copy of the object of the resource
+func (fc *FakeCluster) Get(r *APIResource) (*unstructured.Unstructured, error) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	key, info, err := fc.key(r.GroupVersionKind(), r.Metadata.Namespace, r.Metadata.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := fc.objects[key]
+	if !ok {
+		return nil, errors.NewNotFound(info.Resource.GroupResource(), r.Metadata.Name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+// List returns copies of all objects of the Kind matching the label selector
+func (fc *FakeCluster) List(kind KindInfo, labelSelector string) ([]unstructured.Unstructured, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []unstructured.Unstructured
+	for _, obj := range fc.Objects() {
+		if fc.Kinds()[obj.GroupVersionKind().GroupKind()].Resource != kind.Resource {
+			continue
+		}
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		items = append(items, *obj)
+	}
+	return items, nil
+}
+
+// Apply stores a copy of the object and returns another one.
+// Server-side apply is handled like client-side apply, but fails with
+// a Conflict error without Force, if it changes fields owned by another
+// field manager. Each apply makes kitops the field manager of the applied fields.
+// An existing object is patched with the three-way merge patch of the
+// kubeClient, which keeps labels, annotations and defaulted fields not
+// in the applied configuration. Like the API server it defaults the
+// protocol and target port of Service ports and the protocol of container ports.
+// Changing immutable fields of Jobs and Services fails like in a cluster.
+// The status of an existing object is kept, unless the applied one has a status.
+// Workloads without a status in the applied object are rolled out immediately.
+func (fc *FakeCluster) Apply(obj *unstructured.Unstructured, opts ApplyOptions) (*unstructured.Unstructured, ApplyAction, error) {
+	return fc.apply(obj, opts, fieldManager)
+}
+
+// ApplyAs applies the object with server-side apply as another field manager,
+// which takes the ownership of the applied fields
+func (fc *FakeCluster) ApplyAs(manager string, obj *unstructured.Unstructured) error {
+	_, _, err := fc.apply(obj, ApplyOptions{ServerSide: true, Force: true}, manager)
+	return err
+}
+
+// apply applies the object like Apply as the field manager
+func (fc *FakeCluster) apply(obj *unstructured.Unstructured, opts ApplyOptions, manager string) (*unstructured.Unstructured, ApplyAction, error) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	key, _, err := fc.key(obj.GroupVersionKind(), obj.GetNamespace(), obj.GetName())
+	if err != nil {
+		return nil, "", err
+	}
+
+	applied := obj.DeepCopy()
+	applied.SetNamespace(key.namespace)
+	status, hasStatus := applied.Object["status"]
+	delete(applied.Object, "status")
+	fields := fieldValues(applied)
+	modified, err := setLastApplied(applied)
+	if err != nil {
+		return nil, "", err
+	}
+
+	action := Created
+	current, exists := fc.objects[key]
+	if exists {
+		if err := checkImmutable(current, applied); err != nil {
+			return nil, "", err
+		}
+		if opts.ServerSide && !opts.Force {
+			if err := checkConflicts(current, fields, fc.managers[key], manager); err != nil {
+				return nil, "", err
+			}
+		}
+
+		if applied, action, err = patch(current, modified); err != nil {
+			return nil, "", err
+		}
+		if hasStatus && !equality.Semantic.DeepEqual(status, current.Object["status"]) {
+			action = Updated
+		}
+	}
+
+	setDefaults(applied)
+	if hasStatus {
+		applied.Object["status"] = status
+	} else if !rollout(applied) && exists {
+		if status, ok := current.Object["status"]; ok {
+			applied.Object["status"] = status
+		}
+	}
+
+	if !opts.DryRun {
+		if key.kind == crdKind && action == Created {
+			if err := fc.establish(applied); err != nil {
+				return nil, "", err
+			}
+		}
+		fc.objects[key] = applied
+		if fc.managers[key] == nil {
+			fc.managers[key] = make(map[string]string)
+		}
+		for path := range fields {
+			fc.managers[key][path] = manager
+		}
+	}
+	return applied.DeepCopy(), action, nil
+}
+
+// establish serves the Kind of the CustomResourceDefinition
+// and sets its Established condition
+func (fc *FakeCluster) establish(crd *unstructured.Unstructured) error {
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	kind, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+	plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+	scope, _, _ := unstructured.NestedString(crd.Object, "spec", "scope")
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	var version string
+	if len(versions) > 0 {
+		if v, ok := versions[0].(map[string]interface{}); ok {
+			version, _, _ = unstructured.NestedString(v, "name")
+		}
+	}
+	if len(group) == 0 || len(kind) == 0 || len(plural) == 0 || len(version) == 0 {
+		return fmt.Errorf("invalid CustomResourceDefinition %s", crd.GetName())
+	}
+
+	fc.addKind(schema.GroupVersionKind{Group: group, Version: version, Kind: kind}, plural, scope == "Namespaced")
+	return unstructured.SetNestedSlice(crd.Object, []interface{}{
+		map[string]interface{}{"type": "Established", "status": "True"},
+	}, "status", "conditions")
+}
+
+// Label sets the labels and annotations on the object of the resource
+func (fc *FakeCluster) Label(r *APIResource, labels map[string]string, annotations map[string]string) error {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	k, info, err := fc.key(r.GroupVersionKind(), r.Metadata.Namespace, r.Metadata.Name)
+	if err != nil {
+		return err
+	}
+
+	obj, ok := fc.objects[k]
+	if !ok {
+		return errors.NewNotFound(info.Resource.GroupResource(), r.Metadata.Name)
+	}
+
+	obj.SetLabels(merge(obj.GetLabels(), labels))
+	obj.SetAnnotations(merge(obj.GetAnnotations(), annotations))
+	return nil
+}
+
+// Delete removes the object of the resource
+// Dependents are not tracked, so the propagation policy is ignored.
+func (fc *FakeCluster) Delete(r *APIResource, opts DeleteOptions) error {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+
+	key, info, err := fc.key(r.GroupVersionKind(), r.Metadata.Namespace, r.Metadata.Name)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fc.objects[key]; !ok {
+		return errors.NewNotFound(info.Resource.GroupResource(), r.Metadata.Name)
+	}
+	delete(fc.objects, key)
+	delete(fc.managers, key)
+	return nil
+}
+
+// key returns the key of an object and the API information of its Kind
+// The namespace is defaulted for namespaced Kinds and dropped for cluster wide ones.
+func (fc *FakeCluster) key(gvk schema.GroupVersionKind, namespace string, name string) (fakeKey, KindInfo, error) {
+	info, ok := fc.kinds[gvk.GroupKind()]
+	if !ok {
+		return fakeKey{}, info, fmt.Errorf("no matches for kind %q in group %q", gvk.Kind, gvk.Group)
+	}
+
+	if !info.Namespaced {
+		namespace = ""
+	} else if len(namespace) == 0 {
+		namespace = "default"
+	}
+
+	return fakeKey{
+		group:     gvk.Group,
+		kind:      gvk.Kind,
+		namespace: namespace,
+		name:      name,
+	}, info, nil
+}
+
+// checkImmutable returns an Invalid error if the applied object
+// changes immutable fields of the current one
+func checkImmutable(current *unstructured.Unstructured, applied *unstructured.Unstructured) error {
+	for _, path := range immutableFields[current.GetKind()] {
+		currentValue, currentFound, _ := unstructured.NestedFieldNoCopy(current.Object, path...)
+		appliedValue, appliedFound, _ := unstructured.NestedFieldNoCopy(applied.Object, path...)
+		if !currentFound || !appliedFound || equality.Semantic.DeepEqual(currentValue, appliedValue) {
+			continue
+		}
+		return errors.NewInvalid(current.GroupVersionKind().GroupKind(), current.GetName(), field.ErrorList{
+			field.Invalid(field.NewPath(path[0], path[1:]...), appliedValue, "field is immutable"),
+		})
+	}
+	return nil
+}
+
+// checkConflicts returns a Conflict error like server-side apply,
+// if the fields applied by the manager change the values of fields
+// owned by other managers
+func checkConflicts(current *unstructured.Unstructured, fields map[string]interface{}, managers map[string]string, manager string) error {
+	currentFields := fieldValues(current)
+	var causes []metav1.StatusCause
+	for path, value := range fields {
+		owner, ok := managers[path]
+		if !ok || owner == manager || equality.Semantic.DeepEqual(currentFields[path], value) {
+			continue
+		}
+		causes = append(causes, metav1.StatusCause{
+			Type:    metav1.CauseTypeFieldManagerConflict,
+			Message: fmt.Sprintf("conflict with %q", owner),
+			Field:   "." + path,
+		})
+	}
+	if len(causes) == 0 {
+		return nil
+	}
+
+	sort.Slice(causes, func(i, j int) bool { return causes[i].Field < causes[j].Field })
+	messages := make([]string, len(causes))
+	for i, cause := range causes {
+		messages[i] = cause.Message + ": " + cause.Field
+	}
+	conflicts := "conflicts"
+	if len(causes) == 1 {
+		conflicts = "conflict"
+	}
+	return errors.NewApplyConflict(causes, fmt.Sprintf("Apply failed with %d %s: %s", len(causes), conflicts, strings.Join(messages, ", ")))
+}
+
+// fieldValues returns the values of the fields set in the object by their path
+// Lists are atomic, the identity and the last-applied annotation aren't managed.
+func fieldValues(obj *unstructured.Unstructured) map[string]interface{} {
+	fields := make(map[string]interface{})
+	flatten(obj.Object, "", fields)
+	for _, path := range []string{"apiVersion", "kind", "metadata.name", "metadata.namespace", "metadata.annotations." + lastAppliedAnnotation} {
+		delete(fields, path)
+	}
+	return fields
+}
+
+// flatten adds the values of the nested maps of value to fields by their path
+func flatten(value interface{}, path string, fields map[string]interface{}) {
+	m, ok := value.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		fields[path] = value
+		return
+	}
+	for k, v := range m {
+		if len(path) > 0 {
+			k = path + "." + k
+		}
+		flatten(v, k, fields)
+	}
+}
+
+// patch returns the current object without its status patched
+// to the modified configuration, like the kubeClient does,
+// and Unchanged if the patch is empty
+func patch(current *unstructured.Unstructured, modified []byte) (*unstructured.Unstructured, ApplyAction, error) {
+	live := current.DeepCopy()
+	delete(live.Object, "status")
+	liveJSON, err := live.MarshalJSON()
+	if err != nil {
+		return nil, "", err
+	}
+
+	gvk := current.GroupVersionKind()
+	original := []byte(current.GetAnnotations()[lastAppliedAnnotation])
+	patch, patchType, err := threeWayPatch(gvk, original, modified, liveJSON)
+	if err != nil {
+		return nil, "", err
+	}
+	if string(patch) == "{}" {
+		return live, Unchanged, nil
+	}
+
+	var patched []byte
+	if patchType == types.StrategicMergePatchType {
+		typed, err := scheme.Scheme.New(gvk)
+		if err != nil {
+			return nil, "", err
+		}
+		patched, err = strategicpatch.StrategicMergePatch(liveJSON, patch, typed)
+		if err != nil {
+			return nil, "", err
+		}
+	} else if patched, err = jsonpatch.MergePatch(liveJSON, patch); err != nil {
+		return nil, "", err
+	}
+
+	updated := &unstructured.Unstructured{}
+	if err := updated.UnmarshalJSON(patched); err != nil {
+		return nil, "", err
+	}
+	return updated, Updated, nil
+}
+
+// setDefaults sets the protocol and target port of Service ports
+// and the protocol of container ports, if they aren't set
+func setDefaults(obj *unstructured.Unstructured) {
+	switch obj.GetKind() {
+	case "Service":
+		ports, _, _ := unstructured.NestedSlice(obj.Object, "spec", "ports")
+		for _, p := range ports {
+			if port, ok := p.(map[string]interface{}); ok {
+				if _, ok := port["protocol"]; !ok {
+					port["protocol"] = "TCP"
+				}
+				if _, ok := port["targetPort"]; !ok {
+					port["targetPort"] = port["port"]
+				}
+			}
+		}
+		if len(ports) > 0 {
+			unstructured.SetNestedSlice(obj.Object, ports, "spec", "ports")
+		}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+		containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+		for _, c := range containers {
+			container, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ports, _ := container["ports"].([]interface{})
+			for _, p := range ports {
+				if port, ok := p.(map[string]interface{}); ok {
+					if _, ok := port["protocol"]; !ok {
+						port["protocol"] = "TCP"
+					}
+				}
+			}
+		}
+		if len(containers) > 0 {
+			unstructured.SetNestedSlice(obj.Object, containers, "spec", "template", "spec", "containers")
+		}
+	}
+}
+
+// rollout sets the status of a workload as if it was rolled out or completed
+// and of a PersistentVolumeClaim as if it was bound
+// returns false if the Kind has no such status
+func rollout(obj *unstructured.Unstructured) bool {
+	var status map[string]interface{}
+	switch obj.GetKind() {
+	case "Deployment", "StatefulSet", "ReplicaSet":
+		replicas := replicas(obj)
+		status = map[string]interface{}{
+			"replicas":          replicas,
+			"updatedReplicas":   replicas,
+			"readyReplicas":     replicas,
+			"availableReplicas": replicas,
+		}
+	case "DaemonSet":
+		status = map[string]interface{}{
+			"desiredNumberScheduled": int64(1),
+			"updatedNumberScheduled": int64(1),
+			"numberReady":            int64(1),
+		}
+	case "Job":
+		status = map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Complete", "status": "True"},
+			},
+		}
+	case "PersistentVolumeClaim":
+		status = map[string]interface{}{"phase": "Bound"}
+	case "Pod":
+		status = map[string]interface{}{
+			"phase": "Running",
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "True"},
+			},
+		}
+	default:
+		return false
+	}
+	obj.Object["status"] = status
+	return true
+}
+
+// merge returns the entries of a overwritten by the ones of b
+// or nil if both are empty
+func merge(a map[string]string, b map[string]string) map[string]string {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
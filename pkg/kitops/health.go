@@ -0,0 +1,208 @@
+package kitops
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// defaultHealthTimeout is the default time to wait for resources to become healthy
+	defaultHealthTimeout = 5 * time.Minute
+)
+
+// HealthStatus is the health of a resource in the cluster
+type HealthStatus string
+
+// Health statuses of resources
+const (
+	// Healthy resources are ready, rolled out or completed
+	Healthy HealthStatus = "Healthy"
+	// Progressing resources may become healthy
+	Progressing HealthStatus = "Progressing"
+	// Degraded resources failed and won't become healthy
+	Degraded HealthStatus = "Degraded"
+)
+
+// ResourceHealth holds the health of a resource
+type ResourceHealth struct {
+	Resource *APIResource
+	Status   HealthStatus
+	Message  string `json:",omitempty"`
+}
+
+// healthy returns a bool if the object is healthy
+// returns an error if it failed and won't become healthy
+func healthy(obj *unstructured.Unstructured) (bool, error) {
+	switch obj.GetKind() {
+	case "Deployment":
+		if nestedInt(obj, "status", "observedGeneration") < obj.GetGeneration() {
+			return false, nil
+		}
+		if hasCondition(obj, "Progressing", "False") {
+			return false, fmt.Errorf("Deployment %s exceeded its progress deadline", obj.GetName())
+		}
+		// like kubectl rollout status, wait for the pods of old ReplicaSets to terminate
+		replicas := replicas(obj)
+		updated := nestedInt(obj, "status", "updatedReplicas")
+		return updated >= replicas &&
+			nestedInt(obj, "status", "replicas") <= updated &&
+			nestedInt(obj, "status", "availableReplicas") >= replicas, nil
+	case "StatefulSet":
+		if nestedInt(obj, "status", "observedGeneration") < obj.GetGeneration() {
+			return false, nil
+		}
+		replicas := replicas(obj)
+		if nestedInt(obj, "status", "readyReplicas") < replicas {
+			return false, nil
+		}
+		strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+		if strategy == "OnDelete" {
+			return true, nil
+		}
+		// a partitioned rolling update only updates the pods from the partition on
+		if partition := nestedInt(obj, "spec", "updateStrategy", "rollingUpdate", "partition"); partition > 0 {
+			return nestedInt(obj, "status", "updatedReplicas") >= replicas-partition, nil
+		}
+		currentRevision, _, _ := unstructured.NestedString(obj.Object, "status", "currentRevision")
+		updateRevision, _, _ := unstructured.NestedString(obj.Object, "status", "updateRevision")
+		return nestedInt(obj, "status", "updatedReplicas") == replicas && currentRevision == updateRevision, nil
+	case "ReplicaSet":
+		if nestedInt(obj, "status", "observedGeneration") < obj.GetGeneration() {
+			return false, nil
+		}
+		return nestedInt(obj, "status", "readyReplicas") >= replicas(obj), nil
+	case "DaemonSet":
+		if nestedInt(obj, "status", "observedGeneration") < obj.GetGeneration() {
+			return false, nil
+		}
+		desired := nestedInt(obj, "status", "desiredNumberScheduled")
+		return nestedInt(obj, "status", "updatedNumberScheduled") >= desired &&
+			nestedInt(obj, "status", "numberReady") >= desired, nil
+	case "Job":
+		if hasCondition(obj, "Failed", "True") {
+			return false, fmt.Errorf("Job %s failed", obj.GetName())
+		}
+		return hasCondition(obj, "Complete", "True"), nil
+	case "PersistentVolumeClaim":
+		phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+		if phase == "Lost" {
+			return false, fmt.Errorf("PersistentVolumeClaim %s lost its volume", obj.GetName())
+		}
+		return phase == "Bound", nil
+	case "Pod":
+		phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+		if phase == "Failed" {
+			return false, fmt.Errorf("Pod %s failed", obj.GetName())
+		}
+		return phase == "Succeeded" || hasCondition(obj, "Ready", "True"), nil
+	case crdKind:
+		return hasCondition(obj, "Established", "True"), nil
+	}
+
+	// custom resources reporting their status in conditions
+	if hasCondition(obj, "Stalled", "True") {
+		return false, fmt.Errorf("%s %s is stalled", obj.GetKind(), obj.GetName())
+	}
+	return !hasCondition(obj, "Ready", "False"), nil
+}
+
+// assessHealth waits until the resources are healthy, one of them is degraded
+// or the timeout is reached.
+// returns the health of each resource and an error if not all are healthy
+func assessHealth(ctx context.Context, client ClusterClient, resources []*APIResource, timeout time.Duration) ([]*ResourceHealth, error) {
+	health := make([]*ResourceHealth, len(resources))
+	err := poll(ctx, timeout, func() (bool, error) {
+		done := true
+		var degraded error
+		for i, r := range resources {
+			if health[i] != nil && health[i].Status == Healthy {
+				continue
+			}
+			health[i] = resourceHealth(client, r)
+			switch health[i].Status {
+			case Degraded:
+				degraded = fmt.Errorf("%s %s is degraded: %s", r.Kind, r.Metadata.Name, health[i].Message)
+			case Progressing:
+				done = false
+			}
+		}
+		return done, degraded
+	})
+	if err == wait.ErrWaitTimeout {
+		pending := 0
+		for _, h := range health {
+			if h.Status != Healthy {
+				log.Printf("Resource not healthy Kind: %s Name: %s Namespace: %s", h.Resource.Kind, h.Resource.Metadata.Name, h.Resource.Metadata.Namespace)
+				pending++
+			}
+		}
+		return health, fmt.Errorf("%d resources not healthy after %s", pending, timeout)
+	}
+	return health, err
+}
+
+// waitForHealthy waits until the resources are healthy
+// returns an error if a resource failed, on timeout or if the context is canceled
+func waitForHealthy(ctx context.Context, client ClusterClient, resources []*APIResource, timeout time.Duration) error {
+	_, err := assessHealth(ctx, client, resources, timeout)
+	return err
+}
+
+// poll calls the condition every second until it is done or fails,
+// the timeout is reached or the context is canceled
+// returns wait.ErrWaitTimeout on timeout and the error of the context if it is canceled
+func poll(ctx context.Context, timeout time.Duration, condition wait.ConditionFunc) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := wait.PollImmediateUntil(time.Second, condition, timeoutCtx.Done())
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// resourceHealth returns the current health of the resource
+func resourceHealth(client ClusterClient, r *APIResource) *ResourceHealth {
+	obj, err := client.Get(r)
+	if err != nil {
+		return &ResourceHealth{Resource: r, Status: Progressing, Message: err.Error()}
+	}
+
+	ok, err := healthy(obj)
+	switch {
+	case err != nil:
+		return &ResourceHealth{Resource: r, Status: Degraded, Message: err.Error()}
+	case !ok:
+		return &ResourceHealth{Resource: r, Status: Progressing}
+	}
+	return &ResourceHealth{Resource: r, Status: Healthy}
+}
+
+// replicas returns the desired replicas of a workload, defaulting to 1
+func replicas(obj *unstructured.Unstructured) int64 {
+	if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "replicas"); !found {
+		return 1
+	}
+	return nestedInt(obj, "spec", "replicas")
+}
+
+// nestedInt returns the integer of the field or 0
+// Numbers decoded from manifests are float64, the ones from the cluster int64.
+func nestedInt(obj *unstructured.Unstructured, fields ...string) int64 {
+	value, _, _ := unstructured.NestedFieldNoCopy(obj.Object, fields...)
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package kitops_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/300481/kitops/pkg/kitops"
+)
+
+func TestHealth(t *testing.T) {
+	statefulSet := strings.Replace(appManifest, "kind: Deployment", "kind: StatefulSet", 1)
+	for _, tc := range []struct {
+		name     string
+		manifest string
+		status   string
+		want     kitops.HealthStatus
+	}{
+		{name: "rolled out", want: kitops.Healthy},
+		{name: "progressing", status: "status: {}\n", want: kitops.Progressing},
+		{name: "degraded", status: `status:
+  conditions:
+  - type: Progressing
+    status: "False"
+`, want: kitops.Degraded},
+		{name: "old pods terminating", status: `status:
+  replicas: 2
+  updatedReplicas: 1
+  availableReplicas: 2
+`, want: kitops.Progressing},
+		{name: "StatefulSet rolled out", manifest: statefulSet, status: `status:
+  replicas: 1
+  readyReplicas: 1
+  updatedReplicas: 1
+  currentRevision: app-2
+  updateRevision: app-2
+`, want: kitops.Healthy},
+		{name: "StatefulSet rolling update", manifest: statefulSet, status: `status:
+  replicas: 1
+  readyReplicas: 1
+  updatedReplicas: 0
+  currentRevision: app-1
+  updateRevision: app-2
+`, want: kitops.Progressing},
+		{name: "StatefulSet old revision", manifest: statefulSet, status: `status:
+  replicas: 1
+  readyReplicas: 1
+  updatedReplicas: 1
+  currentRevision: app-1
+  updateRevision: app-2
+`, want: kitops.Progressing},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.manifest) == 0 {
+				tc.manifest = appManifest
+			}
+			repo, commitIDs := newTestRepo(t,
+				map[string]string{"app.yaml": strings.Replace(tc.manifest, "replicas: 1\n", "replicas: 1\n"+tc.status, 1)},
+				map[string]string{},
+			)
+			cluster := kitops.NewFakeCluster()
+
+			cc := kitops.NewClusterConfig(repo, commitIDs[0], cluster)
+			cc.HealthTimeout = 10 * time.Millisecond
+			err := cc.ApplyManifests()
+			if (err == nil) != (tc.want == kitops.Healthy) {
+				t.Errorf("got error %v of %s resources", err, tc.want)
+			}
+
+			for _, h := range cc.Health {
+				want := tc.want
+				if h.Resource.Kind == "Service" {
+					want = kitops.Healthy
+				}
+				if h.Status != want {
+					t.Errorf("got %s %s %s, want %s", h.Resource.Kind, h.Status, h.Message, want)
+				}
+			}
+			if len(cc.Health) != 2 {
+				t.Errorf("got health of %d resources, want 2", len(cc.Health))
+			}
+
+			// the resources applied by a failed commit are cleaned up later
+			cc.Track()
+			cc = kitops.NewClusterConfig(repo, commitIDs[1], cluster)
+			if err := cc.LoadManifests(); err != nil {
+				t.Fatal(err)
+			}
+			cc.Clean()
+			if got := len(managedObjects(cluster)); got != 0 {
+				t.Errorf("got %d objects, want 0", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package kitops
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/300481/kitops/pkg/queue"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// defaultHistoryRetention is the default number of deployments kept in the history
+	defaultHistoryRetention = 20
+	// defaultHistoryFile is the default file of the file history
+	defaultHistoryFile = "/tmp/history.json"
+	historyLabel       = "kitops.io/history"
+	historyKey         = "history"
+)
+
+// Triggers of deployments
+const (
+	// TriggerAPI deployments are enqueued by the /apply endpoint
+	TriggerAPI = "API"
+	// TriggerRollback deployments are enqueued by the /rollback endpoint
+	TriggerRollback = "Rollback"
+	// TriggerAutoRollback deployments are enqueued after a commit failed
+	TriggerAutoRollback = "AutoRollback"
+)
+
+// Deployment is the record of a processed commit
+type Deployment struct {
+	CommitID string
+	// Trigger is the source which enqueued the commit
+	Trigger  string
+	Enqueued time.Time
+	// Attempts is the number of times applying the commit was started
+	Attempts int
+	Started  time.Time
+	Finished time.Time
+	Status   queue.Status
+	// Error is the reason the deployment failed
+	Error   string `json:",omitempty"`
+	Results []*ApplyResult
+	Pruned  []*APIResource
+	// PruneAborted holds the reason if the cleanup was aborted
+	PruneAborted string `json:",omitempty"`
+	RollbackOf   string `json:",omitempty"`
+	RolledBackTo string `json:",omitempty"`
+	// Applied is true if resources of the commit were applied to the cluster
+	Applied bool
+}
+
+// newDeployment returns the Deployment of a queued commit
+// Commits without trigger are enqueued by the API.
+func newDeployment(item *queue.Item[string]) *Deployment {
+	d := &Deployment{
+		CommitID: item.Value,
+		Trigger:  item.Trigger,
+		Enqueued: item.Enqueued,
+		Attempts: item.Attempts,
+	}
+	if len(d.Trigger) == 0 {
+		d.Trigger = TriggerAPI
+	}
+	return d
+}
+
+// HistoryStore records the deployments
+type HistoryStore interface {
+	// Add records the deployment, dropping the oldest ones exceeding the retention
+	Add(d *Deployment) error
+	// List returns the recorded deployments, the oldest first
+	List() []*Deployment
+}
+
+// historyBackend persists the encoded deployments of a History
+type historyBackend interface {
+	load() ([]byte, error)
+	store(data []byte) error
+}
+
+// History is the HistoryStore keeping the deployments in memory
+// and persisting them in its backend, if it has one
+type History struct {
+	// Retention is the number of deployments to keep, 0 keeps all
+	Retention   int
+	deployments []*Deployment
+	backend     historyBackend
+	mux         sync.Mutex
+}
+
+// NewHistory returns a *History keeping the deployments in memory only
+func NewHistory(retention int) *History {
+	return &History{Retention: retention}
+}
+
+// NewFileHistory returns a *History persisted in the file
+// returns an error if the existing history can't be loaded
+func NewFileHistory(path string, retention int) (*History, error) {
+	return newPersistedHistory(&fileHistory{path: path}, retention)
+}
+
+// NewClusterHistory returns a *History persisted in a ConfigMap or Secret
+// in the namespace, named after the source URL like the inventory
+// returns an error if kind is neither ConfigMap nor Secret or the existing
+// history can't be loaded
+func NewClusterHistory(client ClusterClient, kind string, namespace string, url string, retention int) (*History, error) {
+	if kind != "ConfigMap" && kind != "Secret" {
+		return nil, fmt.Errorf("history can't be stored in a %s", kind)
+	}
+
+	var r APIResource
+	r.APIVersion = "v1"
+	r.Kind = kind
+	r.Metadata.Name = "kitops-history-" + ownerHash(url)
+	r.Metadata.Namespace = namespace
+
+	return newPersistedHistory(&clusterHistory{client: client, resource: &r, source: url}, retention)
+}
+
+// newPersistedHistory returns a *History with the deployments loaded from the backend
+func newPersistedHistory(backend historyBackend, retention int) (*History, error) {
+	h := &History{Retention: retention, backend: backend}
+
+	data, err := backend.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &h.deployments); err != nil {
+			return nil, fmt.Errorf("invalid history: %v", err)
+		}
+	}
+	return h, nil
+}
+
+// Add records the deployment and persists the history
+// returns an error if the history can't be persisted
+func (h *History) Add(d *Deployment) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.deployments = append(h.deployments, d)
+	if h.Retention > 0 && len(h.deployments) > h.Retention {
+		h.deployments = h.deployments[len(h.deployments)-h.Retention:]
+	}
+
+	if h.backend == nil {
+		return nil
+	}
+	data, err := json.Marshal(h.deployments)
+	if err != nil {
+		return err
+	}
+	return h.backend.store(data)
+}
+
+// List returns the recorded deployments, the oldest first
+func (h *History) List() []*Deployment {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	deployments := make([]*Deployment, len(h.deployments))
+	copy(deployments, h.deployments)
+	return deployments
+}
+
+// fileHistory persists the history in a local file
+type fileHistory struct {
+	path string
+}
+
+// load returns the content of the file or nothing if it doesn't exist
+func (fh *fileHistory) load() ([]byte, error) {
+	data, err := ioutil.ReadFile(fh.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// store replaces the file by writing a temporary one and renaming it,
+// so a crash doesn't leave a truncated history
+func (fh *fileHistory) store(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fh.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := fh.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fh.path)
+}
+
+// clusterHistory persists the history in a ConfigMap or Secret
+type clusterHistory struct {
+	client   ClusterClient
+	resource *APIResource
+	source   string
+}
+
+// load returns the history stored in the resource or nothing if it doesn't exist
+func (ch *clusterHistory) load() ([]byte, error) {
+	obj, err := ch.client.Get(ch.resource)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := unstructured.NestedString(obj.Object, "data", historyKey)
+	if err != nil || ch.resource.Kind != "Secret" {
+		return []byte(data), err
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// store applies the resource with the history server-side,
+// like the inventory
+func (ch *clusterHistory) store(data []byte) error {
+	value := string(data)
+	if ch.resource.Kind == "Secret" {
+		value = base64.StdEncoding.EncodeToString(data)
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(ch.resource.APIVersion)
+	obj.SetKind(ch.resource.Kind)
+	obj.SetName(ch.resource.Metadata.Name)
+	obj.SetNamespace(ch.resource.Metadata.Namespace)
+	obj.SetLabels(map[string]string{historyLabel: ownerHash(ch.source)})
+	obj.SetAnnotations(map[string]string{sourceAnnotation: ch.source})
+	if err := unstructured.SetNestedField(obj.Object, value, "data", historyKey); err != nil {
+		return err
+	}
+
+	_, _, err := ch.client.Apply(obj, ApplyOptions{ServerSide: true, Force: true})
+	return err
+}
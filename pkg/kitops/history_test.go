@@ -0,0 +1,105 @@
+package kitops_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/300481/kitops/pkg/kitops"
+	"github.com/300481/kitops/pkg/queue"
+)
+
+func TestFileHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.json")
+
+	history, err := kitops.NewFileHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, commitID := range []string{"first", "second", "third"} {
+		if err := history.Add(&kitops.Deployment{CommitID: commitID, Status: queue.Successful}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := kitops.NewFileHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployments := loaded.List()
+	if len(deployments) != 2 || deployments[0].CommitID != "second" || deployments[1].CommitID != "third" {
+		t.Errorf("got deployments %v, want the last two", deployments)
+	}
+}
+
+func TestClusterHistory(t *testing.T) {
+	cluster := kitops.NewFakeCluster()
+
+	for _, kind := range []string{"ConfigMap", "Secret"} {
+		history, err := kitops.NewClusterHistory(cluster, kind, "kitops", "https://example.com/repo.git", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := history.Add(&kitops.Deployment{CommitID: "first", Trigger: kitops.TriggerAPI}); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := kitops.NewClusterHistory(cluster, kind, "kitops", "https://example.com/repo.git", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deployments := loaded.List(); len(deployments) != 1 || deployments[0].Trigger != kitops.TriggerAPI {
+			t.Errorf("got %s history %v", kind, deployments)
+		}
+	}
+
+	if _, err := kitops.NewClusterHistory(cluster, "Service", "kitops", "https://example.com/repo.git", 0); err == nil {
+		t.Error("got no error storing the history in a Service")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{"app.yaml": appManifest},
+		map[string]string{"app.yaml": appManifest, "config.yaml": configManifest},
+		map[string]string{"app.yaml": degradedManifest},
+	)
+	cluster := kitops.NewFakeCluster()
+	notifications := make(channelNotifier, 10)
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.Notifier = notifications
+	qp.History = kitops.NewHistory(2)
+	q := queue.New[string](qp)
+
+	q.Add(commitIDs[0], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+	q.Add(commitIDs[1], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[1])
+	q.Add(commitIDs[2], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventFailed, commitIDs[2])
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := qp.History.List()
+	if len(deployments) != 2 {
+		t.Fatalf("got %d deployments, want 2", len(deployments))
+	}
+	if d := deployments[0]; d.CommitID != commitIDs[1] || d.Status != queue.Successful || d.Trigger != kitops.TriggerAPI || len(d.Results) != 3 {
+		t.Errorf("got deployment %+v", d)
+	}
+	if d := deployments[1]; d.CommitID != commitIDs[2] || d.Status != queue.Failed || len(d.Error) == 0 || d.Finished.Before(d.Started) {
+		t.Errorf("got deployment %+v", d)
+	}
+	if _, ok := qp.ClusterConfigs[commitIDs[0]]; ok {
+		t.Error("ClusterConfig of the commit dropped from the history was kept")
+	}
+}
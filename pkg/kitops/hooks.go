@@ -0,0 +1,148 @@
+package kitops
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// hookAnnotation makes a resource a hook run in the phase of its value
+	hookAnnotation = "kitops.io/hook"
+	// hookDeletePolicyAnnotation sets the deletion policy of a hook
+	hookDeletePolicyAnnotation = "kitops.io/hook-delete-policy"
+)
+
+// Phases of running hooks
+const (
+	// PreSync hooks run before applying a commit
+	PreSync = "PreSync"
+	// PostSync hooks run after successfully applying a commit
+	PostSync = "PostSync"
+)
+
+// Deletion policies of hooks
+const (
+	// HookBeforeCreation deletes an existing hook before it runs again
+	HookBeforeCreation = "BeforeHookCreation"
+	// HookSucceeded deletes a hook after it succeeded
+	HookSucceeded = "HookSucceeded"
+	// HookFailed deletes a hook after it failed
+	HookFailed = "HookFailed"
+)
+
+// hook is a resource run in a phase of applying a commit
+type hook struct {
+	resource     *APIResource
+	object       *unstructured.Unstructured
+	phase        string
+	deletePolicy string
+}
+
+// validHookDeletePolicy returns a bool if the deletion policy is known
+func validHookDeletePolicy(policy string) bool {
+	return policy == HookBeforeCreation || policy == HookSucceeded || policy == HookFailed
+}
+
+// newHook returns the hook of the object or nil if it is no hook
+// returns an error if the hook annotations are invalid
+func newHook(obj *unstructured.Unstructured) (*hook, error) {
+	annotations := obj.GetAnnotations()
+	phase, ok := annotations[hookAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	if phase != PreSync && phase != PostSync {
+		return nil, fmt.Errorf("invalid %s of %s %s: %q", hookAnnotation, obj.GetKind(), obj.GetName(), phase)
+	}
+
+	deletePolicy := annotations[hookDeletePolicyAnnotation]
+	if len(deletePolicy) > 0 && !validHookDeletePolicy(deletePolicy) {
+		return nil, fmt.Errorf("invalid %s of %s %s: %q", hookDeletePolicyAnnotation, obj.GetKind(), obj.GetName(), deletePolicy)
+	}
+
+	return &hook{
+		resource:     newResourceFromObject(obj),
+		object:       obj,
+		phase:        phase,
+		deletePolicy: deletePolicy,
+	}, nil
+}
+
+// isHook returns a bool if the resource with the checksum is a hook of the collection
+func (c *Collection) isHook(checksum string) bool {
+	for _, h := range c.hooks {
+		if h.resource.Checksum() == checksum {
+			return true
+		}
+	}
+	return false
+}
+
+// runHooks runs the hooks of the phase ordered by Kind with the apply options
+// and waits for them to complete. Hooks without a deletion policy are deleted
+// with the default one.
+// returns an error if a hook failed
+func (c *Collection) runHooks(ctx context.Context, phase string, defaultPolicy string, opts ApplyOptions) error {
+	var hooks []*hook
+	for _, h := range c.hooks {
+		if h.phase == phase {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return kindPriority(hooks[i].resource.Kind) < kindPriority(hooks[j].resource.Kind)
+	})
+
+	var resources []*APIResource
+	for _, h := range hooks {
+		if h.policy(defaultPolicy) == HookBeforeCreation {
+			if err := c.deleteHook(ctx, h); err != nil {
+				return err
+			}
+		}
+
+		if _, _, err := c.client.Apply(h.object, opts); err != nil {
+			return fmt.Errorf("%s hook Kind: %s Name: %s Namespace: %s: %w", phase, h.resource.Kind, h.resource.Metadata.Name, h.resource.Metadata.Namespace, err)
+		}
+		log.Printf("Run %s hook Kind: %s Name: %s Namespace: %s", phase, h.resource.Kind, h.resource.Metadata.Name, h.resource.Metadata.Namespace)
+		resources = append(resources, h.resource)
+	}
+
+	err := waitForHealthy(ctx, c.client, resources, c.healthTimeout)
+	for _, h := range hooks {
+		policy := h.policy(defaultPolicy)
+		if (err == nil && policy == HookSucceeded) || (err != nil && policy == HookFailed) {
+			if err := c.deleteHook(ctx, h); err != nil {
+				log.Printf("Error deleting %s hook: %v", phase, err)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s hooks: %w", phase, err)
+	}
+	return nil
+}
+
+// policy returns the deletion policy of the hook or the default policy
+func (h *hook) policy(defaultPolicy string) string {
+	if len(h.deletePolicy) > 0 {
+		return h.deletePolicy
+	}
+	return defaultPolicy
+}
+
+// deleteHook deletes the hook with its dependents and waits until it is gone
+func (c *Collection) deleteHook(ctx context.Context, h *hook) error {
+	if err := h.resource.Delete(c.client, DeleteOptions{Propagation: metav1.DeletePropagationBackground}); err != nil {
+		return err
+	}
+	return h.resource.waitForDeleted(ctx, c.client, c.healthTimeout)
+}
@@ -0,0 +1,170 @@
+package kitops_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/300481/kitops/pkg/kitops"
+	"github.com/300481/kitops/pkg/queue"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	hookManifest = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: hook
+  namespace: test
+  annotations:
+    kitops.io/hook: %s
+`
+	failedStatus = `status:
+  conditions:
+  - type: Failed
+    status: "True"
+`
+)
+
+// hookExists returns a bool if the Job of the hook manifest exists
+func hookExists(cluster kitops.ClusterClient) bool {
+	var job kitops.APIResource
+	job.APIVersion = "batch/v1"
+	job.Kind = "Job"
+	job.Metadata.Name = "hook"
+	job.Metadata.Namespace = "test"
+	return job.Exists(cluster)
+}
+
+func TestPreSyncHookFailed(t *testing.T) {
+	repo, commitIDs := newTestRepo(t, map[string]string{
+		"app.yaml":  appManifest,
+		"hook.yaml": fmt.Sprintf(hookManifest, "PreSync") + failedStatus,
+	})
+	cluster := kitops.NewFakeCluster()
+
+	if err := kitops.NewClusterConfig(repo, commitIDs[0], cluster).ApplyManifests(); err == nil {
+		t.Error("got no error of the failed hook")
+	}
+	if got := len(managedObjects(cluster)); got != 1 || !hookExists(cluster) {
+		t.Errorf("got %d objects, want only the hook", got)
+	}
+}
+
+func TestPostSyncHook(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{
+			"app.yaml":  appManifest,
+			"hook.yaml": fmt.Sprintf(hookManifest, "PostSync"),
+		},
+		map[string]string{"app.yaml": appManifest},
+	)
+	cluster := kitops.NewFakeCluster()
+
+	for _, commitID := range commitIDs {
+		cc := kitops.NewClusterConfig(repo, commitID, cluster)
+		if err := cc.ApplyManifests(); err != nil {
+			t.Fatal(err)
+		}
+		cc.Label()
+		cc.Clean()
+
+		if !hookExists(cluster) {
+			t.Errorf("hook of commit %s doesn't exist", commitID)
+		}
+	}
+}
+
+// optionsCluster records the apply options of each Kind
+type optionsCluster struct {
+	*kitops.FakeCluster
+	options map[string]kitops.ApplyOptions
+}
+
+func (oc *optionsCluster) Apply(obj *unstructured.Unstructured, opts kitops.ApplyOptions) (*unstructured.Unstructured, kitops.ApplyAction, error) {
+	oc.options[obj.GetKind()] = opts
+	return oc.FakeCluster.Apply(obj, opts)
+}
+
+func TestHookApplyOptions(t *testing.T) {
+	repo, commitIDs := newTestRepo(t, map[string]string{
+		"app.yaml":  appManifest,
+		"hook.yaml": fmt.Sprintf(hookManifest, "PreSync"),
+	})
+	cluster := &optionsCluster{FakeCluster: kitops.NewFakeCluster(), options: map[string]kitops.ApplyOptions{}}
+
+	cc := kitops.NewClusterConfig(repo, commitIDs[0], cluster)
+	cc.ApplyOptions = kitops.ApplyOptions{ServerSide: true, Force: true}
+	if err := cc.ApplyManifests(); err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"Job", "Deployment"} {
+		if got := cluster.options[kind]; got != cc.ApplyOptions {
+			t.Errorf("got %s applied with %+v, want %+v", kind, got, cc.ApplyOptions)
+		}
+	}
+}
+
+// timeoutCluster fails applying the first Jobs with a server timeout
+type timeoutCluster struct {
+	*kitops.FakeCluster
+	timeouts int
+}
+
+func (tc *timeoutCluster) Apply(obj *unstructured.Unstructured, opts kitops.ApplyOptions) (*unstructured.Unstructured, kitops.ApplyAction, error) {
+	if obj.GetKind() == "Job" && tc.timeouts > 0 {
+		tc.timeouts--
+		return nil, "", apierrors.NewServerTimeout(schema.GroupResource{Group: "batch", Resource: "jobs"}, "create", 1)
+	}
+	return tc.FakeCluster.Apply(obj, opts)
+}
+
+func TestHookRetried(t *testing.T) {
+	repo, commitIDs := newTestRepo(t, map[string]string{
+		"app.yaml":  appManifest,
+		"hook.yaml": fmt.Sprintf(hookManifest, "PreSync"),
+	})
+	cluster := &timeoutCluster{FakeCluster: kitops.NewFakeCluster(), timeouts: 1}
+	notifications := make(channelNotifier, 10)
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.Notifier = notifications
+	q := queue.New[string](qp)
+	q.Retry(&queue.RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond, Retryable: kitops.Retryable})
+
+	q.Add(commitIDs[0], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := qp.History.List()
+	if len(deployments) != 2 || deployments[0].Status != queue.Retrying {
+		t.Fatalf("got deployments %+v, want the timed out hook retried", deployments)
+	}
+	if d := deployments[1]; d.Status != queue.Successful || d.Attempts != 2 {
+		t.Errorf("got %s after %d attempts, want %s after 2", d.Status, d.Attempts, queue.Successful)
+	}
+}
+
+func TestHookDeletePolicy(t *testing.T) {
+	repo, commitIDs := newTestRepo(t, map[string]string{
+		"app.yaml":  appManifest,
+		"hook.yaml": fmt.Sprintf(hookManifest, "PostSync"),
+	})
+	cluster := kitops.NewFakeCluster()
+
+	cc := kitops.NewClusterConfig(repo, commitIDs[0], cluster)
+	cc.HookDeletePolicy = kitops.HookSucceeded
+	if err := cc.ApplyManifests(); err != nil {
+		t.Fatal(err)
+	}
+
+	if hookExists(cluster) {
+		t.Error("succeeded hook was not deleted")
+	}
+}
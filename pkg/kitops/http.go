@@ -6,13 +6,23 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 // routes sets the routes
 func (k *Kitops) routes() {
 	k.router.HandleFunc("/healthz", k.healthHandler).Methods("GET")
 	k.router.HandleFunc("/apply", k.applyHandler).Methods("GET")
+	k.router.HandleFunc("/plan", k.planHandler).Methods("GET")
+	k.router.HandleFunc("/diff", k.diffHandler).Methods("GET")
 	k.router.HandleFunc("/clusterconfig", k.clusterConfigHandler).Methods("GET")
+	k.router.HandleFunc("/rollback", k.rollbackHandler).Methods("POST")
+	k.router.HandleFunc("/restore", k.restoreHandler).Methods("POST")
+	k.router.HandleFunc("/history", k.historyHandler).Methods("GET")
+	k.router.HandleFunc("/deadletters", k.deadLettersHandler).Methods("GET")
+	k.router.HandleFunc("/deadletters/redrive", k.redriveHandler).Methods("POST")
+	k.router.HandleFunc("/api/v1/queue", k.queueHandler).Methods("GET")
+	k.router.HandleFunc("/api/v1/status", k.statusHandler).Methods("GET")
 }
 
 // healthHandler handles the /healthz endpoint
@@ -28,27 +38,219 @@ func (k *Kitops) applyHandler(w http.ResponseWriter, r *http.Request) {
 
 	commitID := r.URL.Query().Get("commitid")
 
-	if len(commitID) != 40 {
+	if !validCommitID(commitID) {
 		handleError(fmt.Errorf("apply.handler got no or wrong commitID"), w)
 		return
 	}
 
 	log.Printf("apply.handler got commitID: %s\n", commitID)
 
-	k.queue.Add(commitID)
+	if err := k.queue.Add(commitID, TriggerAPI); err != nil {
+		handleError(err, w)
+		return
+	}
 
 	// respond OK
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, "OK")
 }
 
+// planHandler writes the Plan of a commitID as response
+func (k *Kitops) planHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("plan.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	commitID := r.URL.Query().Get("commitid")
+
+	if !validCommitID(commitID) {
+		handleError(fmt.Errorf("plan.handler got no or wrong commitID"), w)
+		return
+	}
+
+	log.Printf("plan.handler got commitID: %s\n", commitID)
+
+	plan, err := k.Plan(commitID)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(plan)
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
+// diffHandler writes the Diff of a commitID as response
+func (k *Kitops) diffHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("diff.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	commitID := r.URL.Query().Get("commitid")
+
+	if !validCommitID(commitID) {
+		handleError(fmt.Errorf("diff.handler got no or wrong commitID"), w)
+		return
+	}
+
+	log.Printf("diff.handler got commitID: %s\n", commitID)
+
+	diff, err := k.Diff(commitID)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(diff)
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
+// rollbackHandler enqueues a previously applied commit to be applied again
+// and writes the Rollback as response. With plan=true it only writes the Plan.
+func (k *Kitops) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("rollback.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	to := r.URL.Query().Get("to")
+	log.Printf("rollback.handler got commitID: %q\n", to)
+
+	var response interface{}
+	var err error
+	if r.URL.Query().Get("plan") == "true" {
+		response, err = k.RollbackPlan(to)
+	} else {
+		response, err = k.Rollback(to)
+	}
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(response)
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
+// restoreHandler applies the backup of a commitID and writes the Restore as response
+func (k *Kitops) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("restore.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	commitID := r.URL.Query().Get("commitid")
+
+	if !validCommitID(commitID) {
+		handleError(fmt.Errorf("restore.handler got no or wrong commitID"), w)
+		return
+	}
+
+	log.Printf("restore.handler got commitID: %s\n", commitID)
+
+	restored, err := k.Restore(commitID)
+	if err != nil && len(restored) == 0 {
+		handleError(err, w)
+		return
+	}
+
+	restore := &Restore{CommitID: commitID, Restored: restored}
+	if err != nil {
+		restore.Error = err.Error()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(restore)
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
 // clusterConfigHandler writes the ClusterConfig as response
 func (k *Kitops) clusterConfigHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("clusterconfig.handler:", r.Method, "request from ", r.RemoteAddr)
 
 	w.WriteHeader(http.StatusOK)
 	enc := json.NewEncoder(w)
-	err := enc.Encode(k.queueProcessor.ClusterConfigs)
+	err := enc.Encode(k.queueProcessor.ClusterConfigSnapshot())
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
+// historyHandler writes the processed commits as response
+func (k *Kitops) historyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("history.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(k.History())
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
+// deadLettersHandler writes the permanently failed commits as response
+func (k *Kitops) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("deadletters.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(k.DeadLetters())
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
+// redriveHandler enqueues the failed commit of a dead letter again
+// and writes the queue item as response
+func (k *Kitops) redriveHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("redrive.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		handleError(fmt.Errorf("redrive.handler got no or wrong id"), w)
+		return
+	}
+
+	log.Printf("redrive.handler got id: %d\n", id)
+
+	item, err := k.Redrive(id)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(item)
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
+// queueHandler writes the QueueState as response
+func (k *Kitops) queueHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("queue.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(k.QueueState())
+	if err != nil {
+		handleError(err, w)
+	}
+}
+
+// statusHandler writes the Status as response
+func (k *Kitops) statusHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("status.handler:", r.Method, "request from ", r.RemoteAddr)
+
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(k.Status())
 	if err != nil {
 		handleError(err, w)
 	}
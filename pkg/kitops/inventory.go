@@ -0,0 +1,78 @@
+package kitops
+
+import (
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// defaultInventoryNamespace is the namespace of the inventories if not configured
+	defaultInventoryNamespace = "kitops"
+	inventoryLabel            = "kitops.io/inventory"
+	inventoryKey              = "inventory"
+)
+
+// Inventory holds the resources applied from a source
+// by the last successful ClusterConfig
+type Inventory struct {
+	Source    string
+	CommitID  string
+	Resources []*APIResource
+}
+
+// inventoryResource returns the resource of the ConfigMap
+// holding the inventory of the source URL
+func inventoryResource(namespace string, url string) *APIResource {
+	var ar APIResource
+	ar.APIVersion = "v1"
+	ar.Kind = "ConfigMap"
+	ar.Metadata.Name = "kitops-inventory-" + ownerHash(url)
+	ar.Metadata.Namespace = namespace
+	return &ar
+}
+
+// loadInventory returns the inventory of the source URL stored in the namespace
+// returns a NotFound error if there is no inventory yet
+func loadInventory(client ClusterClient, namespace string, url string) (*Inventory, error) {
+	obj, err := client.Get(inventoryResource(namespace, url))
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := unstructured.NestedString(obj.Object, "data", inventoryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var inventory Inventory
+	if err := json.Unmarshal([]byte(data), &inventory); err != nil {
+		return nil, err
+	}
+	return &inventory, nil
+}
+
+// save stores the inventory in a ConfigMap in the namespace
+// It's applied server-side, since the last-applied annotation of
+// a client-side apply would double the size of large inventories.
+func (inv *Inventory) save(client ClusterClient, namespace string) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	r := inventoryResource(namespace, inv.Source)
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(r.APIVersion)
+	obj.SetKind(r.Kind)
+	obj.SetName(r.Metadata.Name)
+	obj.SetNamespace(r.Metadata.Namespace)
+	obj.SetLabels(map[string]string{inventoryLabel: ownerHash(inv.Source)})
+	obj.SetAnnotations(map[string]string{sourceAnnotation: inv.Source})
+	if err := unstructured.SetNestedField(obj.Object, string(data), "data", inventoryKey); err != nil {
+		return err
+	}
+
+	_, _, err = client.Apply(obj, ApplyOptions{ServerSide: true, Force: true})
+	return err
+}
@@ -1,19 +1,32 @@
 package kitops
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/300481/kitops/pkg/queue"
 	"github.com/300481/kitops/pkg/sourcerepo"
 	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// shutdownTimeout is the time to finish the queued commits on termination
+	shutdownTimeout = 25 * time.Second
 )
 
 // Kitops is the instance type
 type Kitops struct {
 	router         *mux.Router
-	queue          *queue.Queue
+	queue          *queue.Queue[string]
 	queueProcessor *QueueProcessor
 }
 
@@ -32,12 +45,40 @@ func New() *Kitops {
 		return nil
 	}
 
-	qp := &QueueProcessor{
-		ClusterConfigs: make(map[string]*ClusterConfig),
-		repository:     repo,
+	client, err := newKubeClient()
+
+	if err != nil {
+		log.Printf("unable to get client for the cluster\n%v", err)
+		return nil
+	}
+
+	qp := NewQueueProcessor(repo, client)
+	qp.AutoRollback = boolEnv("KITOPS_AUTO_ROLLBACK")
+	qp.ReplaceOnConflict = boolEnv("KITOPS_REPLACE_ON_CONFLICT")
+	if url := os.Getenv("KITOPS_NOTIFICATION_URL"); len(url) > 0 {
+		qp.Notifier = NewWebhookNotifier(url)
+	}
+	qp.applyOptions = ApplyOptions{
+		ServerSide: boolEnv("KITOPS_SERVER_SIDE_APPLY"),
+		Force:      boolEnv("KITOPS_FORCE_CONFLICTS"),
+	}
+	qp.PruneOptions = PruneOptions{
+		Propagation: propagationEnv("KITOPS_PRUNE_PROPAGATION"),
+		MaxCount:    intEnv("KITOPS_PRUNE_MAX_COUNT"),
+		MaxPercent:  intEnv("KITOPS_PRUNE_MAX_PERCENT"),
+	}
+	qp.archive = newArchive()
+	qp.hookPolicy = hookPolicyEnv("KITOPS_HOOK_DELETE_POLICY")
+	qp.healthTimeout = durationEnv("KITOPS_HEALTH_TIMEOUT")
+	qp.namespace = os.Getenv("KITOPS_NAMESPACE")
+	if qp.History, err = newHistory(client, url, qp.namespace); err != nil {
+		log.Printf("unable to load the history\n%v", err)
+		return nil
 	}
 
-	q := queue.New(qp)
+	q := queue.New[string](qp)
+	coalesce(q, qp)
+	q.Retry(newRetryPolicy())
 
 	return &Kitops{
 		router:         mux.NewRouter(),
@@ -48,6 +89,245 @@ func New() *Kitops {
 
 // Serve runs the application in server mode
 func (k *Kitops) Serve() {
+	// restore the queue only in server mode, other commands mustn't process it
+	if path := os.Getenv("KITOPS_QUEUE_JOURNAL"); len(path) > 0 {
+		q, err := queue.NewDurable[string](k.queueProcessor, path)
+		if err != nil {
+			log.Fatalf("unable to open the queue journal: %s\n%v", path, err)
+		}
+		coalesce(q, k.queueProcessor)
+		q.Retry(newRetryPolicy())
+		k.queue.Close()
+		k.queue = q
+	}
 	k.routes()
-	log.Fatal(http.ListenAndServe(":8080", k.router))
+	server := &http.Server{Addr: ":8080", Handler: k.router}
+
+	// on termination, finish the queued commits within the shutdown timeout
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down the server: %v", err)
+		}
+		if err := k.queue.Drain(ctx); err != nil {
+			log.Printf("Queue not drained, the commit in progress is canceled: %v", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// Plan returns the changes applying the commitID would make to the cluster
+func (k *Kitops) Plan(commitID string) (*Plan, error) {
+	if !validCommitID(commitID) {
+		return nil, fmt.Errorf("invalid commitID: %q", commitID)
+	}
+	return k.queueProcessor.Plan(commitID)
+}
+
+// Diff returns the differences between the commitID and the cluster
+func (k *Kitops) Diff(commitID string) (*Diff, error) {
+	if !validCommitID(commitID) {
+		return nil, fmt.Errorf("invalid commitID: %q", commitID)
+	}
+	return k.queueProcessor.Diff(commitID)
+}
+
+// Rollback enqueues the previously applied commit to be applied again
+// If to is empty, it is the commit applied before the current one.
+func (k *Kitops) Rollback(to string) (*Rollback, error) {
+	if len(to) > 0 && !validCommitID(to) {
+		return nil, fmt.Errorf("invalid commitID: %q", to)
+	}
+	return k.queueProcessor.Rollback(k.queue, to)
+}
+
+// RollbackPlan returns the changes rolling back to the commit would make
+// If to is empty, it is the commit applied before the current one.
+func (k *Kitops) RollbackPlan(to string) (*Plan, error) {
+	if len(to) > 0 && !validCommitID(to) {
+		return nil, fmt.Errorf("invalid commitID: %q", to)
+	}
+	return k.queueProcessor.RollbackPlan(to)
+}
+
+// Restore applies the objects backed up before they were changed by the commitID
+func (k *Kitops) Restore(commitID string) ([]*APIResource, error) {
+	if !validCommitID(commitID) {
+		return nil, fmt.Errorf("invalid commitID: %q", commitID)
+	}
+	return k.queueProcessor.Restore(commitID)
+}
+
+// QueueState returns the pending, in progress and recently processed commits
+func (k *Kitops) QueueState() *QueueState {
+	return k.queueProcessor.QueueState(k.queue)
+}
+
+// Status returns the summary of the commits applied to the cluster
+func (k *Kitops) Status() *Status {
+	return k.queueProcessor.Status(k.queue)
+}
+
+// DeadLetters returns the commits failed permanently, the oldest first
+func (k *Kitops) DeadLetters() []*queue.DeadLetter[string] {
+	return k.queue.DeadLetters()
+}
+
+// Redrive enqueues the failed commit of the dead letter with the id again
+func (k *Kitops) Redrive(id uint64) (*queue.Item[string], error) {
+	return k.queue.Redrive(id, TriggerRedrive)
+}
+
+// coalesce makes the queue skip the commits superseded by newer ones,
+// if configured by the environment. All commits target the cluster
+// of the QueueProcessor.
+func coalesce(q *queue.Queue[string], qp *QueueProcessor) {
+	if !boolEnv("KITOPS_QUEUE_COALESCE") {
+		return
+	}
+	q.Coalesce(func(commitID string) string {
+		return qp.repository.URL
+	})
+}
+
+// newArchive returns the archive of the backups configured by the environment
+// It returns nil if the backup is disabled.
+func newArchive() *Archive {
+	if value := os.Getenv("KITOPS_BACKUP"); len(value) > 0 && !boolEnv("KITOPS_BACKUP") {
+		return nil
+	}
+
+	archive := &Archive{
+		Directory: os.Getenv("KITOPS_BACKUP_DIRECTORY"),
+		Retention: defaultBackupRetention,
+	}
+	if len(archive.Directory) == 0 {
+		archive.Directory = defaultBackupDirectory
+	}
+	if len(os.Getenv("KITOPS_BACKUP_RETENTION")) > 0 {
+		archive.Retention = intEnv("KITOPS_BACKUP_RETENTION")
+	}
+	return archive
+}
+
+// History returns the processed commits, the oldest first
+func (k *Kitops) History() []*Deployment {
+	return k.queueProcessor.History.List()
+}
+
+// newHistory returns the history of the deployments of the source URL
+// configured by the environment
+// returns an error if the configured history can't be loaded
+func newHistory(client ClusterClient, url string, namespace string) (HistoryStore, error) {
+	retention := defaultHistoryRetention
+	if len(os.Getenv("KITOPS_HISTORY_RETENTION")) > 0 {
+		retention = intEnv("KITOPS_HISTORY_RETENTION")
+	}
+	if len(namespace) == 0 {
+		namespace = defaultInventoryNamespace
+	}
+
+	switch backend := strings.ToLower(os.Getenv("KITOPS_HISTORY")); backend {
+	case "", "memory":
+		return NewHistory(retention), nil
+	case "file":
+		path := os.Getenv("KITOPS_HISTORY_FILE")
+		if len(path) == 0 {
+			path = defaultHistoryFile
+		}
+		return NewFileHistory(path, retention)
+	case "configmap":
+		return NewClusterHistory(client, "ConfigMap", namespace, url, retention)
+	case "secret":
+		return NewClusterHistory(client, "Secret", namespace, url, retention)
+	default:
+		return nil, fmt.Errorf("invalid value of KITOPS_HISTORY: %q", backend)
+	}
+}
+
+// hookPolicyEnv returns the deletion policy of hooks of the environment variable
+// It returns an empty string if the variable is not set or invalid.
+func hookPolicyEnv(name string) string {
+	value := os.Getenv(name)
+	if len(value) > 0 && !validHookDeletePolicy(value) {
+		log.Printf("invalid value of %s: %q", name, value)
+		return ""
+	}
+	return value
+}
+
+// durationEnv returns the positive duration of the environment variable
+// It returns 0 if the variable is not set or invalid.
+func durationEnv(name string) time.Duration {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return 0
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("invalid value of %s: %q", name, value)
+		return 0
+	}
+	return d
+}
+
+// boolEnv returns the boolean value of the environment variable
+// It returns false if the variable is not set or invalid.
+func boolEnv(name string) bool {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return false
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid value of %s: %q", name, value)
+		return false
+	}
+	return b
+}
+
+// intEnv returns the non-negative integer value of the environment variable
+// It returns 0 if the variable is not set or invalid.
+func intEnv(name string) int {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return 0
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		log.Printf("invalid value of %s: %q", name, value)
+		return 0
+	}
+	return i
+}
+
+// propagationEnv returns the deletion propagation policy of the environment variable
+// It returns the default policy if the variable is not set or invalid.
+func propagationEnv(name string) metav1.DeletionPropagation {
+	policy, err := parsePropagation(os.Getenv(name))
+	if err != nil {
+		log.Printf("invalid value of %s: %v", name, err)
+		return ""
+	}
+	return policy
+}
+
+// validCommitID returns true if commitID is a full commit hash
+func validCommitID(commitID string) bool {
+	return len(commitID) == 40
 }
@@ -0,0 +1,316 @@
+package kitops
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+	fieldManager          = "kitops"
+)
+
+// kubeClient is the ClusterClient for the Kubernetes API
+type kubeClient struct {
+	dynamic dynamic.Interface
+	mapper  *restmapper.DeferredDiscoveryRESTMapper
+	kinds   *clusterKinds
+}
+
+// newKubeClient returns an initialized *kubeClient
+// It uses the in-cluster configuration if kitops runs in a Pod,
+// the kubeconfig of the environment otherwise.
+func newKubeClient() (*kubeClient, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(),
+			&clientcmd.ConfigOverrides{},
+		).ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	cachedDiscovery := memory.NewMemCacheClient(discoveryClient)
+
+	return &kubeClient{
+		dynamic: dynamicClient,
+		mapper:  restmapper.NewDeferredDiscoveryRESTMapper(cachedDiscovery),
+		kinds:   newClusterKinds(cachedDiscovery),
+	}, nil
+}
+
+// resourceInterface returns the dynamic client interface for the resource
+// returns an error if the Kind is unknown to the cluster
+func (kc *kubeClient) resourceInterface(r *APIResource) (dynamic.ResourceInterface, error) {
+	ri, _, err := kc.resourceInterfaceFor(r.GroupVersionKind(), r.Metadata.Namespace)
+	return ri, err
+}
+
+// resourceInterfaceFor returns the dynamic client interface for the kind in the namespace
+// and a bool if the kind is namespaced
+// returns an error if the kind is unknown to the cluster
+func (kc *kubeClient) resourceInterfaceFor(gvk schema.GroupVersionKind, namespace string) (dynamic.ResourceInterface, bool, error) {
+	mapping, err := kc.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		// the kind may be served by a CRD applied in this run
+		kc.mapper.Reset()
+		mapping, err = kc.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return kc.dynamic.Resource(mapping.Resource).Namespace(namespace), true, nil
+	}
+	return kc.dynamic.Resource(mapping.Resource), false, nil
+}
+
+// Kinds returns the API information of all Kinds
+// freshly discovered from the cluster
+func (kc *kubeClient) Kinds() map[schema.GroupKind]KindInfo {
+	return kc.kinds.getAll()
+}
+
+// Get returns the object of the resource from the cluster
+func (kc *kubeClient) Get(r *APIResource) (*unstructured.Unstructured, error) {
+	ri, err := kc.resourceInterface(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return ri.Get(context.TODO(), r.Metadata.Name, metav1.GetOptions{})
+}
+
+// Label sets the labels and annotations on the resource in the cluster
+func (kc *kubeClient) Label(r *APIResource, labels map[string]string, annotations map[string]string) error {
+	ri, err := kc.resourceInterface(r)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = ri.Patch(context.TODO(), r.Metadata.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// Delete deletes the resource from the cluster
+func (kc *kubeClient) Delete(r *APIResource, opts DeleteOptions) error {
+	ri, err := kc.resourceInterface(r)
+	if err != nil {
+		return err
+	}
+
+	deleteOptions := metav1.DeleteOptions{}
+	if len(opts.Propagation) > 0 {
+		deleteOptions.PropagationPolicy = &opts.Propagation
+	}
+	return ri.Delete(context.TODO(), r.Metadata.Name, deleteOptions)
+}
+
+// List returns all objects of the Kind in all namespaces matching the label selector
+func (kc *kubeClient) List(kind KindInfo, labelSelector string) ([]unstructured.Unstructured, error) {
+	list, err := kc.dynamic.Resource(kind.Resource).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// Apply creates the object in the cluster or patches the existing one.
+// Like kubectl apply it stores the applied configuration in an annotation
+// to compute a three-way merge patch on the next apply, a strategic merge
+// patch for the Kinds of the client-go scheme.
+// A dry run is done by the API server without persisting the result.
+func (kc *kubeClient) Apply(obj *unstructured.Unstructured, opts ApplyOptions) (*unstructured.Unstructured, ApplyAction, error) {
+	obj = obj.DeepCopy()
+
+	if len(obj.GetNamespace()) == 0 {
+		obj.SetNamespace("default")
+	}
+	ri, namespaced, err := kc.resourceInterfaceFor(obj.GroupVersionKind(), obj.GetNamespace())
+	if err != nil {
+		return nil, "", err
+	}
+	if !namespaced {
+		obj.SetNamespace("")
+	}
+
+	var dryRun []string
+	if opts.DryRun {
+		dryRun = []string{metav1.DryRunAll}
+	}
+
+	if opts.ServerSide {
+		return kc.serverSideApply(ri, obj, opts.Force, dryRun)
+	}
+
+	modified, err := setLastApplied(obj)
+	if err != nil {
+		return nil, "", err
+	}
+
+	current, err := ri.Get(context.TODO(), obj.GetName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		created, err := ri.Create(context.TODO(), obj, metav1.CreateOptions{DryRun: dryRun, FieldManager: fieldManager})
+		return created, Created, err
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	currentJSON, err := current.MarshalJSON()
+	if err != nil {
+		return nil, "", err
+	}
+
+	original := []byte(current.GetAnnotations()[lastAppliedAnnotation])
+	patch, patchType, err := threeWayPatch(obj.GroupVersionKind(), original, modified, currentJSON)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if string(patch) == "{}" {
+		return current, Unchanged, nil
+	}
+
+	updated, err := ri.Patch(context.TODO(), obj.GetName(), patchType, patch, metav1.PatchOptions{DryRun: dryRun, FieldManager: fieldManager})
+	return updated, Updated, err
+}
+
+// threeWayPatch returns the patch from the current to the modified
+// configuration, deleting the fields of the original one no longer set,
+// and its type. Like kubectl apply it is a strategic merge patch for the
+// Kinds of the client-go scheme, merging lists like containers and ports
+// by their keys to keep the fields defaulted by the API server.
+// Custom resources get a JSON merge patch, replacing lists as a whole.
+func threeWayPatch(gvk schema.GroupVersionKind, original, modified, current []byte) ([]byte, types.PatchType, error) {
+	typed, err := scheme.Scheme.New(gvk)
+	if runtime.IsNotRegisteredError(err) {
+		patch, err := jsonmergepatch.CreateThreeWayJSONMergePatch(original, modified, current)
+		return patch, types.MergePatchType, err
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	lookup, err := strategicpatch.NewPatchMetaFromStruct(typed)
+	if err != nil {
+		return nil, "", err
+	}
+	patch, err := strategicpatch.CreateThreeWayMergePatch(original, modified, current, lookup, true)
+	return patch, types.StrategicMergePatchType, err
+}
+
+// serverSideApply applies the object with server-side apply
+// force takes the ownership of conflicting fields
+// A conflict error lists the conflicting fields and their managers.
+func (kc *kubeClient) serverSideApply(ri dynamic.ResourceInterface, obj *unstructured.Unstructured, force bool, dryRun []string) (*unstructured.Unstructured, ApplyAction, error) {
+	current, err := ri.Get(context.TODO(), obj.GetName(), metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, "", err
+	}
+	exists := err == nil
+
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, "", err
+	}
+
+	applied, err := ri.Patch(context.TODO(), obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+		DryRun:       dryRun,
+		Force:        &force,
+		FieldManager: fieldManager,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !exists {
+		return applied, Created, nil
+	}
+
+	// a dry run doesn't increase the resourceVersion
+	if len(dryRun) > 0 {
+		currentYAML, err := normalizedYAML(current)
+		if err != nil {
+			return nil, "", err
+		}
+		appliedYAML, err := normalizedYAML(applied)
+		if err != nil {
+			return nil, "", err
+		}
+		if currentYAML == appliedYAML {
+			return applied, Unchanged, nil
+		}
+		return applied, Updated, nil
+	}
+
+	if applied.GetResourceVersion() == current.GetResourceVersion() {
+		return applied, Unchanged, nil
+	}
+	return applied, Updated, nil
+}
+
+// setLastApplied stores the configuration of the object in the
+// last-applied annotation and returns the annotated object as JSON
+func setLastApplied(obj *unstructured.Unstructured) ([]byte, error) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	delete(annotations, lastAppliedAnnotation)
+	obj.SetAnnotations(annotations)
+	if len(annotations) == 0 {
+		obj.SetAnnotations(nil)
+	}
+
+	applied, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	annotations[lastAppliedAnnotation] = string(applied)
+	obj.SetAnnotations(annotations)
+
+	return obj.MarshalJSON()
+}
@@ -0,0 +1,78 @@
+package kitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Events of notifications
+const (
+	EventSuccessful = "Successful"
+	EventFailed     = "Failed"
+	EventRollback   = "Rollback"
+	// EventPruneAborted alerts that the cleanup of a commit exceeded the prune limits
+	EventPruneAborted = "PruneAborted"
+)
+
+// Notification holds the information about a deployment
+type Notification struct {
+	Event    string `json:"event"`
+	CommitID string `json:"commitID"`
+	// RollbackCommitID is the commit rolled back to
+	RollbackCommitID string `json:"rollbackCommitID,omitempty"`
+	// Text is the human readable message
+	Text string `json:"text"`
+}
+
+// Notifier sends notifications about deployments
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// LogNotifier writes the notifications to the log
+type LogNotifier struct{}
+
+// Notify writes the notification to the log
+func (LogNotifier) Notify(n *Notification) error {
+	log.Printf("Notification %s: %s", n.Event, n.Text)
+	return nil
+}
+
+// WebhookNotifier posts the notifications as JSON to an URL
+// The text field makes them compatible with Slack and Mattermost webhooks.
+type WebhookNotifier struct {
+	URL    string
+	client *http.Client
+}
+
+// NewWebhookNotifier returns a *WebhookNotifier posting to the url
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify posts the notification to the URL of the webhook
+// returns an error if it can't be sent or isn't accepted
+func (wn *WebhookNotifier) Notify(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := wn.client.Post(wn.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package kitops
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	crdKind = "CustomResourceDefinition"
+	// syncWaveAnnotation sets the wave the resource is applied in.
+	// Lower waves are applied first, the default is 0.
+	syncWaveAnnotation = "kitops.io/sync-wave"
+)
+
+// Wave holds the resources applied together
+// Wave by wave, the resources have to be healthy before the next one is applied.
+type Wave struct {
+	Number    int
+	Resources []*APIResource
+}
+
+var (
+	// applyOrder is the order of applying the Kinds
+	// Kinds not listed are applied after the workloads and before the webhooks.
+	applyOrder = []string{
+		// namespaces and policies
+		"Namespace",
+		"NetworkPolicy",
+		"ResourceQuota",
+		"LimitRange",
+		"PodSecurityPolicy",
+		"PodDisruptionBudget",
+		"PriorityClass",
+		// custom resource definitions
+		crdKind,
+		// RBAC
+		"ServiceAccount",
+		"ClusterRole",
+		"ClusterRoleBinding",
+		"Role",
+		"RoleBinding",
+		// config and storage
+		"Secret",
+		"ConfigMap",
+		"StorageClass",
+		"PersistentVolume",
+		"PersistentVolumeClaim",
+		// services and workloads
+		"Service",
+		"DaemonSet",
+		"Pod",
+		"ReplicationController",
+		"ReplicaSet",
+		"Deployment",
+		"HorizontalPodAutoscaler",
+		"StatefulSet",
+		"Job",
+		"CronJob",
+		"Ingress",
+		"APIService",
+	}
+
+	// applyLast are the Kinds applied after all others,
+	// since they may reject objects until their services are running
+	applyLast = []string{
+		"MutatingWebhookConfiguration",
+		"ValidatingWebhookConfiguration",
+	}
+
+	// crdTimeout is the time to wait for CustomResourceDefinitions to be established
+	crdTimeout = time.Minute
+)
+
+// kindPriority returns the position of the Kind in the order of applying
+func kindPriority(kind string) int {
+	for i, k := range applyOrder {
+		if k == kind {
+			return i
+		}
+	}
+	for i, k := range applyLast {
+		if k == kind {
+			return len(applyOrder) + 1 + i
+		}
+	}
+	return len(applyOrder)
+}
+
+// sorted returns the checksums of the objects loaded from manifests
+// ordered by Kind and keeping the order of the manifests within a Kind
+func (c *Collection) sorted() []string {
+	order := make([]string, len(c.order))
+	copy(order, c.order)
+	sort.SliceStable(order, func(i, j int) bool {
+		return kindPriority(c.Items[order[i]].Kind) < kindPriority(c.Items[order[j]].Kind)
+	})
+	return order
+}
+
+// Waves returns the resources loaded from manifests grouped by
+// their sync wave in the order of applying
+func (c *Collection) Waves() []Wave {
+	numbers, checksums := c.waves()
+	waves := make([]Wave, 0, len(numbers))
+	for _, number := range numbers {
+		wave := Wave{Number: number}
+		for _, checksum := range checksums[number] {
+			wave.Resources = append(wave.Resources, c.Items[checksum])
+		}
+		waves = append(waves, wave)
+	}
+	return waves
+}
+
+// waves returns the ascending numbers of the sync waves
+// and the checksums of each wave ordered by Kind
+func (c *Collection) waves() ([]int, map[int][]string) {
+	var numbers []int
+	checksums := make(map[int][]string)
+	for _, checksum := range c.sorted() {
+		number := syncWave(c.objects[checksum])
+		if _, ok := checksums[number]; !ok {
+			numbers = append(numbers, number)
+		}
+		checksums[number] = append(checksums[number], checksum)
+	}
+	sort.Ints(numbers)
+	return numbers, checksums
+}
+
+// syncWave returns the sync wave of the object
+// It returns 0 if the object isn't annotated or the annotation is invalid.
+func syncWave(obj *unstructured.Unstructured) int {
+	value, ok := obj.GetAnnotations()[syncWaveAnnotation]
+	if !ok {
+		return 0
+	}
+	wave, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid %s of %s %s: %q", syncWaveAnnotation, obj.GetKind(), obj.GetName(), value)
+		return 0
+	}
+	return wave
+}
+
+// waitForEstablished waits until the CustomResourceDefinition of the resource
+// is established, so objects of its Kind can be applied.
+// returns an error on timeout or if the context is canceled
+func waitForEstablished(ctx context.Context, client ClusterClient, r *APIResource, timeout time.Duration) error {
+	log.Printf("Wait for CustomResourceDefinition %s to be established", r.Metadata.Name)
+	err := poll(ctx, timeout, func() (bool, error) {
+		obj, err := client.Get(r)
+		if err != nil {
+			return false, nil
+		}
+		return hasCondition(obj, "Established", "True"), nil
+	})
+	if err != nil {
+		return fmt.Errorf("CustomResourceDefinition %s not established: %v", r.Metadata.Name, err)
+	}
+	return nil
+}
+
+// hasCondition returns a bool if the object has the condition with the status
+func hasCondition(obj *unstructured.Unstructured, conditionType string, status string) bool {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == conditionType && condition["status"] == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package kitops
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// labels and annotations marking the resources managed by kitops
+const (
+	// ownerLabel holds a hash of the source URL, which is a valid label value of any URL
+	ownerLabel = "kitops.io/owner"
+	// legacyOwnerLabel holds the source URL with replaced ':' and '/'
+	legacyOwnerLabel = "managedBy"
+
+	sourceAnnotation = "kitops.io/source"
+	pathAnnotation   = "kitops.io/path"
+	commitAnnotation = "kitops.io/commit"
+)
+
+// ownerHash returns the hash of the source URL used in labels and names
+func ownerHash(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return fmt.Sprintf("%x", sum[:20])
+}
+
+// ownerSelector returns the label selector of the resources managed by kitops for the source URL
+func ownerSelector(url string) string {
+	return ownerLabel + "=" + ownerHash(url)
+}
+
+// legacyOwnerSelector returns the label selector used by earlier kitops versions
+// for the source URL, or an empty string if it never was a valid label
+func legacyOwnerSelector(url string) string {
+	value := strings.ReplaceAll(strings.ReplaceAll(url, ":", "-"), "/", "-")
+	if len(validation.IsValidLabelValue(value)) > 0 {
+		return ""
+	}
+	return legacyOwnerLabel + "=" + value
+}
+
+// ownedBy returns a bool if the object was labelled by kitops for the source URL
+// Objects without source annotation are labelled by earlier kitops versions.
+func ownedBy(obj *unstructured.Unstructured, url string) bool {
+	source, ok := obj.GetAnnotations()[sourceAnnotation]
+	return !ok || source == url
+}
@@ -0,0 +1,94 @@
+package kitops
+
+import (
+	"context"
+	"fmt"
+)
+
+// Plan holds the changes applying a ClusterConfig would make to the cluster
+type Plan struct {
+	CommitID  string
+	Create    []*APIResource
+	Update    []*APIResource
+	Replace   []*APIResource
+	Unchanged []*APIResource
+	Prune     []*APIResource
+	// PruneAborted holds the reason if the cleanup would be aborted
+	PruneAborted string `json:",omitempty"`
+	Errors       []string
+}
+
+// Plan loads the manifests of the ClusterConfig and returns the changes
+// applying and cleaning would make, without changing the cluster.
+// It returns an error if the manifests can't be loaded.
+func (cc *ClusterConfig) Plan() (*Plan, error) {
+	if err := cc.LoadManifests(); err != nil {
+		return nil, err
+	}
+
+	opts := cc.ApplyOptions
+	opts.DryRun = true
+	results, errs := cc.APIResources.apply(context.Background(), opts)
+
+	plan := &Plan{CommitID: cc.CommitID}
+	for _, result := range results {
+		switch result.Action {
+		case Created:
+			plan.Create = append(plan.Create, result.Resource)
+		case Updated:
+			plan.Update = append(plan.Update, result.Resource)
+		case Replaced:
+			plan.Replace = append(plan.Replace, result.Resource)
+		case Unchanged:
+			plan.Unchanged = append(plan.Unchanged, result.Resource)
+		}
+	}
+	for _, err := range errs {
+		plan.Errors = append(plan.Errors, err.Error())
+	}
+
+	managed, err := cc.managed()
+	if err != nil {
+		plan.Errors = append(plan.Errors, fmt.Sprintf("getting managed resources: %v", err))
+		return plan, nil
+	}
+	plan.Prune = cc.prunable(managed)
+	if err := cc.PruneOptions.check(len(plan.Prune), len(managed.Items)); err != nil {
+		plan.PruneAborted = err.Error()
+	}
+
+	return plan, nil
+}
+
+// planRollback returns the changes applying the resources of the target
+// deployment again would make after the current one. Resources of both
+// deployments are listed as updated, their changes aren't known.
+func planRollback(target *Deployment, current *Deployment, opts PruneOptions) *Plan {
+	plan := &Plan{CommitID: target.CommitID}
+
+	// resources are identified by group, kind, namespace and name,
+	// a changed apiVersion updates the same object
+	currentResources := make(map[string]bool)
+	for _, result := range current.Results {
+		currentResources[result.Resource.Checksum()] = true
+	}
+	targetResources := make(map[string]bool)
+	for _, result := range target.Results {
+		targetResources[result.Resource.Checksum()] = true
+		if currentResources[result.Resource.Checksum()] {
+			plan.Update = append(plan.Update, result.Resource)
+		} else {
+			plan.Create = append(plan.Create, result.Resource)
+		}
+	}
+	for _, result := range current.Results {
+		if !targetResources[result.Resource.Checksum()] {
+			plan.Prune = append(plan.Prune, result.Resource)
+		}
+	}
+
+	if err := opts.check(len(plan.Prune), len(current.Results)); err != nil {
+		plan.PruneAborted = err.Error()
+	}
+	return plan
+}
@@ -0,0 +1,59 @@
+package kitops
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// pruneAnnotation set to "false" protects a resource from being pruned
+	pruneAnnotation = "kitops.io/prune"
+)
+
+// PruneOptions holds the safeguards for cleaning up resources
+type PruneOptions struct {
+	// Propagation is the policy for deleting the dependents of pruned resources
+	Propagation metav1.DeletionPropagation
+	// MaxCount aborts the cleanup, if more resources would be pruned. 0 disables the limit.
+	MaxCount int
+	// MaxPercent aborts the cleanup, if more percent of the managed resources
+	// would be pruned. 0 disables the limit.
+	MaxPercent int
+}
+
+// parsePropagation returns the deletion propagation policy of the case insensitive name
+// foreground, background or orphan. An empty name returns the default policy of the kinds.
+func parsePropagation(name string) (metav1.DeletionPropagation, error) {
+	for _, policy := range []metav1.DeletionPropagation{metav1.DeletePropagationForeground, metav1.DeletePropagationBackground, metav1.DeletePropagationOrphan} {
+		if strings.EqualFold(name, string(policy)) {
+			return policy, nil
+		}
+	}
+	if len(name) == 0 {
+		return "", nil
+	}
+	return "", fmt.Errorf("invalid propagation policy: %q", name)
+}
+
+// check returns an error if pruning count of managed resources exceeds the limits
+func (po PruneOptions) check(count int, managed int) error {
+	if po.MaxCount > 0 && count > po.MaxCount {
+		return fmt.Errorf("%d resources would be pruned, the maximum is %d", count, po.MaxCount)
+	}
+	if po.MaxPercent > 0 && managed > 0 && count*100 > po.MaxPercent*managed {
+		return fmt.Errorf("%d of %d managed resources would be pruned, the maximum is %d%%", count, managed, po.MaxPercent)
+	}
+	return nil
+}
+
+// protected returns a bool if the resource is annotated in the cluster
+// to be protected from pruning
+func protected(client ClusterClient, r *APIResource) bool {
+	obj, err := client.Get(r)
+	if err != nil {
+		return false
+	}
+	return obj.GetAnnotations()[pruneAnnotation] == "false"
+}
@@ -1,7 +1,11 @@
 package kitops
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/300481/kitops/pkg/queue"
 	"github.com/300481/kitops/pkg/sourcerepo"
@@ -9,34 +13,428 @@ import (
 
 // QueueProcessor is the instance for processsing the queue items
 type QueueProcessor struct {
+	// ClusterConfigs are the processed commits of the history
 	ClusterConfigs map[string]*ClusterConfig
-	repository     *sourcerepo.SourceRepo
+	// configsMux guards ClusterConfigs, it isn't held while a commit is processed
+	configsMux sync.RWMutex
+	// AutoRollback enqueues the last successful commit when a commit fails
+	AutoRollback bool
+	// ReplaceOnConflict replaces all resources failing with changed immutable fields
+	ReplaceOnConflict bool
+	// Notifier sends the notifications about the processed commits
+	Notifier Notifier
+	// PruneOptions limit the cleanup of the commits
+	PruneOptions PruneOptions
+	// History records the processed commits
+	History HistoryStore
+	// rollbacks maps the queue items of the rollbacks to the commits rolled back
+	rollbacks map[uint64]string
+	// rollbacksMux guards rollbacks, it isn't held while a commit is processed
+	rollbacksMux  sync.Mutex
+	repository    *sourcerepo.SourceRepo
+	client        ClusterClient
+	applyOptions  ApplyOptions
+	archive       *Archive
+	hookPolicy    string
+	healthTimeout time.Duration
+	namespace     string
+	// mux serializes the checkouts of the repository
+	mux sync.Mutex
 }
 
-// Process processes new queued commitIDs
-func (qp *QueueProcessor) Process(q *queue.Queue) {
-	commitID := q.StartNext().(string)
+// NewQueueProcessor returns a *QueueProcessor applying the commits
+// of the repository to the cluster of the client with the default options
+func NewQueueProcessor(repository *sourcerepo.SourceRepo, client ClusterClient) *QueueProcessor {
+	return &QueueProcessor{
+		ClusterConfigs: make(map[string]*ClusterConfig),
+		Notifier:       LogNotifier{},
+		History:        NewHistory(defaultHistoryRetention),
+		rollbacks:      make(map[uint64]string),
+		repository:     repository,
+		client:         client,
+	}
+}
+
+// Process applies and cleans up a queued commitID
+// Canceling the context stops waiting for the resources of the commit.
+// returns an error if the commit failed
+func (qp *QueueProcessor) Process(ctx context.Context, q *queue.Queue[string], item *queue.Item[string]) error {
+	commitID := item.Value
+
+	qp.mux.Lock()
+	defer qp.mux.Unlock()
+
+	deployment := newDeployment(item)
+	deployment.Started = time.Now()
 
 	// create a new ClusterConfig
-	cc := NewClusterConfig(qp.repository, commitID)
-	qp.ClusterConfigs[commitID] = cc
+	cc := qp.newClusterConfig(commitID)
+	qp.rollbacksMux.Lock()
+	cc.RollbackOf = qp.rollbacks[item.ID]
+	delete(qp.rollbacks, item.ID)
+	qp.rollbacksMux.Unlock()
 
-	// apply the manifests
-	if err := cc.ApplyManifests(); err != nil {
+	// load and apply the manifests
+	if err := cc.ApplyManifestsContext(ctx); err != nil {
 		log.Printf("failed to apply manifests of commitID: %s", commitID)
-		q.Finish(false)
-	} else {
-		q.Finish(true)
-	}
+		// keep track of the resources applied anyway, but don't clean up,
+		// without manifests every managed resource would be cleaned up
+		cc.Track()
+		deployment.Error = err.Error()
 
-	// load the manifests in the ClusterConfig
-	if err := cc.LoadManifests(); err != nil {
-		log.Printf("failed to load manifests of commitID: %s", commitID)
+		// a canceled commit isn't rolled back, it may be applied again
+		if ctx.Err() != nil {
+			qp.record(deployment, cc, queue.Canceled)
+			return err
+		}
+
+		// a commit retried by the queue isn't rolled back before its last attempt
+		if q.WillRetry(item, err) {
+			log.Printf("Retry commit %s after attempt %d failed: %v", commitID, item.Attempts, err)
+			qp.record(deployment, cc, queue.Retrying)
+			return err
+		}
+
+		var lastSuccessful string
+		if applied := qp.applied(); len(applied) > 0 {
+			lastSuccessful = applied[len(applied)-1]
+		}
+		qp.notify(&Notification{
+			Event:    EventFailed,
+			CommitID: commitID,
+			Text:     fmt.Sprintf("Commit %s failed: %v", commitID, err),
+		})
+		qp.rollback(q, cc, lastSuccessful)
+
+		qp.record(deployment, cc, queue.Failed)
+		return err
 	}
 
 	// label the api resources
-	qp.ClusterConfigs[commitID].Label()
+	cc.Label()
 
 	// cleanup resources which are not in the current commit, but managed by kitops
-	qp.ClusterConfigs[commitID].Clean()
+	cc.Clean()
+	if len(cc.PruneAborted) > 0 {
+		qp.notify(&Notification{
+			Event:    EventPruneAborted,
+			CommitID: commitID,
+			Text:     fmt.Sprintf("Cleanup of commit %s aborted: %s", commitID, cc.PruneAborted),
+		})
+	}
+
+	text := fmt.Sprintf("Commit %s applied", commitID)
+	if len(cc.RollbackOf) > 0 {
+		text += fmt.Sprintf(" as rollback of commit %s", cc.RollbackOf)
+	}
+	if len(cc.PruneAborted) > 0 {
+		text += ", cleanup aborted"
+	}
+	qp.notify(&Notification{Event: EventSuccessful, CommitID: commitID, Text: text})
+
+	qp.record(deployment, cc, queue.Successful)
+	return nil
+}
+
+// Skip records a commit superseded by a newer one in a coalescing queue
+func (qp *QueueProcessor) Skip(item *queue.Item[string]) {
+	qp.rollbacksMux.Lock()
+	delete(qp.rollbacks, item.ID)
+	qp.rollbacksMux.Unlock()
+
+	d := newDeployment(item)
+	d.Started = time.Now()
+	d.Finished = d.Started
+	d.Status = queue.Skipped
+	if err := qp.History.Add(d); err != nil {
+		log.Printf("Error recording the deployment of commit %s: %v", d.CommitID, err)
+	}
+}
+
+// record adds the deployment of the ClusterConfig with the status to the history,
+// the ClusterConfig to the ClusterConfigs and drops the ones of the commits
+// no longer in the history.
+// It must be called with the mutex locked.
+func (qp *QueueProcessor) record(d *Deployment, cc *ClusterConfig, status queue.Status) {
+	d.Finished = time.Now()
+	d.Status = status
+	d.Results = cc.Results
+	d.Pruned = cc.Pruned
+	d.PruneAborted = cc.PruneAborted
+	d.RollbackOf = cc.RollbackOf
+	d.RolledBackTo = cc.RolledBackTo
+	d.Applied = cc.applied
+
+	if err := qp.History.Add(d); err != nil {
+		log.Printf("Error recording the deployment of commit %s: %v", d.CommitID, err)
+	}
+
+	recorded := make(map[string]bool)
+	for _, deployment := range qp.History.List() {
+		recorded[deployment.CommitID] = true
+	}
+
+	qp.configsMux.Lock()
+	defer qp.configsMux.Unlock()
+
+	qp.ClusterConfigs[cc.CommitID] = cc
+	for commitID := range qp.ClusterConfigs {
+		if !recorded[commitID] {
+			delete(qp.ClusterConfigs, commitID)
+		}
+	}
+}
+
+// ClusterConfigSnapshot returns a copy of the ClusterConfigs
+// The ClusterConfigs aren't changed after they are recorded.
+func (qp *QueueProcessor) ClusterConfigSnapshot() map[string]*ClusterConfig {
+	qp.configsMux.RLock()
+	defer qp.configsMux.RUnlock()
+
+	snapshot := make(map[string]*ClusterConfig, len(qp.ClusterConfigs))
+	for commitID, cc := range qp.ClusterConfigs {
+		snapshot[commitID] = cc
+	}
+	return snapshot
+}
+
+// applied returns the successfully applied commits of the history
+// in the order of applying, a commit applied again directly after
+// itself is listed once
+func (qp *QueueProcessor) applied() []string {
+	return appliedCommits(qp.History.List())
+}
+
+// appliedCommits returns the successfully applied commits of the deployments
+// like applied
+func appliedCommits(deployments []*Deployment) []string {
+	var applied []string
+	for _, d := range deployments {
+		if d.Status != queue.Successful {
+			continue
+		}
+		if len(applied) == 0 || applied[len(applied)-1] != d.CommitID {
+			applied = append(applied, d.CommitID)
+		}
+	}
+	return applied
+}
+
+// rollback enqueues the last successful commit after the ClusterConfig failed,
+// if auto rollback is enabled. A failed rollback isn't rolled back again.
+// Newer pending commits may fix the failure, so the rollback is skipped
+// instead of being applied after them or superseding them.
+func (qp *QueueProcessor) rollback(q *queue.Queue[string], cc *ClusterConfig, lastSuccessful string) {
+	if !qp.AutoRollback || len(lastSuccessful) == 0 || lastSuccessful == cc.CommitID || len(cc.RollbackOf) > 0 {
+		return
+	}
+	// the rollback would supersede the newer commits pending in a coalescing queue
+	if q.Superseded(cc.CommitID) {
+		log.Printf("Skip rollback of commit %s, a newer commit is pending", cc.CommitID)
+		return
+	}
+
+	if _, err := qp.enqueueRollback(q, lastSuccessful, cc.CommitID, TriggerAutoRollback); err != nil {
+		log.Printf("Error enqueueing rollback to commit %s: %v", lastSuccessful, err)
+		return
+	}
+
+	log.Printf("Rollback of commit %s to commit %s", cc.CommitID, lastSuccessful)
+	cc.RolledBackTo = lastSuccessful
+	qp.notify(&Notification{
+		Event:            EventRollback,
+		CommitID:         cc.CommitID,
+		RollbackCommitID: lastSuccessful,
+		Text:             fmt.Sprintf("Commit %s failed, rolling back to commit %s", cc.CommitID, lastSuccessful),
+	})
+}
+
+// Rollback is a commit enqueued to be applied again
+type Rollback struct {
+	// CommitID is the commit applied again
+	CommitID string
+	// RollbackOf is the commit rolled back
+	RollbackOf string
+}
+
+// Rollback enqueues the previously applied commit to, or the commit applied
+// before the current one if to is empty, to be applied and cleaned up again.
+// It doesn't wait for the commit in progress, the rollback is applied after it.
+// returns an error if the commit wasn't applied successfully before
+func (qp *QueueProcessor) Rollback(q *queue.Queue[string], to string) (*Rollback, error) {
+	applied := qp.applied()
+	target, err := rollbackTarget(applied, to)
+	if err != nil {
+		return nil, err
+	}
+	rollback := &Rollback{
+		CommitID:   target,
+		RollbackOf: applied[len(applied)-1],
+	}
+	if _, err := qp.enqueueRollback(q, target, rollback.RollbackOf, TriggerRollback); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Rollback of commit %s to commit %s", rollback.RollbackOf, rollback.CommitID)
+	qp.notify(&Notification{
+		Event:            EventRollback,
+		CommitID:         rollback.RollbackOf,
+		RollbackCommitID: target,
+		Text:             fmt.Sprintf("Rolling back commit %s to commit %s", rollback.RollbackOf, target),
+	})
+	return rollback, nil
+}
+
+// enqueueRollback adds the commit to to the queue as rollback of the commit of
+// with the trigger and returns the queue item
+func (qp *QueueProcessor) enqueueRollback(q *queue.Queue[string], to string, of string, trigger string) (*queue.Item[string], error) {
+	// the rollback is recorded before the worker can process the item
+	qp.rollbacksMux.Lock()
+	defer qp.rollbacksMux.Unlock()
+
+	item := &queue.Item[string]{Value: to, Trigger: trigger}
+	if err := q.AddItem(item); err != nil {
+		return nil, err
+	}
+	qp.rollbacks[item.ID] = of
+	return item, nil
+}
+
+// RollbackPlan returns the changes rolling back to the commit would make
+// compared to the current commit. It is computed from the resources of their
+// deployments in the history, without loading the manifests.
+// returns an error if the commit wasn't applied successfully before
+func (qp *QueueProcessor) RollbackPlan(to string) (*Plan, error) {
+	deployments := qp.History.List()
+	applied := appliedCommits(deployments)
+	target, err := rollbackTarget(applied, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var targetDeployment, currentDeployment *Deployment
+	for _, d := range deployments {
+		if d.Status != queue.Successful {
+			continue
+		}
+		if d.CommitID == target {
+			targetDeployment = d
+		}
+		if d.CommitID == applied[len(applied)-1] {
+			currentDeployment = d
+		}
+	}
+	return planRollback(targetDeployment, currentDeployment, qp.PruneOptions), nil
+}
+
+// rollbackTarget returns the commit of the applied ones to roll back to
+func rollbackTarget(applied []string, to string) (string, error) {
+	if len(to) == 0 {
+		if len(applied) < 2 {
+			return "", fmt.Errorf("no commit applied before the current one")
+		}
+		return applied[len(applied)-2], nil
+	}
+
+	for _, commitID := range applied {
+		if commitID == to {
+			return to, nil
+		}
+	}
+	return "", fmt.Errorf("commit %s was not applied successfully", to)
+}
+
+// notify sends the notification, errors are logged
+func (qp *QueueProcessor) notify(n *Notification) {
+	if qp.Notifier == nil {
+		return
+	}
+	if err := qp.Notifier.Notify(n); err != nil {
+		log.Printf("Error sending notification of commit %s: %v", n.CommitID, err)
+	}
+}
+
+// Plan returns the changes applying the commitID would make to the cluster
+func (qp *QueueProcessor) Plan(commitID string) (*Plan, error) {
+	qp.mux.Lock()
+	defer qp.mux.Unlock()
+
+	return qp.newClusterConfig(commitID).Plan()
+}
+
+// Diff returns the differences between the commitID and the cluster
+func (qp *QueueProcessor) Diff(commitID string) (*Diff, error) {
+	qp.mux.Lock()
+	defer qp.mux.Unlock()
+
+	return qp.newClusterConfig(commitID).Diff()
+}
+
+// Restore is the result of restoring the backup of a commit
+type Restore struct {
+	// CommitID is the commit the backup was made before
+	CommitID string
+	// Restored are the resources applied from the backup
+	Restored []*APIResource
+	// Error is set if objects failed to restore
+	Error string `json:",omitempty"`
+}
+
+// Restore applies the objects backed up before they were changed by the commitID
+// returns the restored resources and an error if the backup can't be loaded
+// or objects failed to restore
+func (qp *QueueProcessor) Restore(commitID string) ([]*APIResource, error) {
+	if qp.archive == nil {
+		return nil, fmt.Errorf("backup is disabled")
+	}
+
+	qp.mux.Lock()
+	defer qp.mux.Unlock()
+
+	objects, err := qp.archive.Backup(commitID).Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var restored []*APIResource
+	failed := 0
+	for _, obj := range objects {
+		resource := newResourceFromObject(obj)
+		if _, _, err := qp.client.Apply(obj, qp.applyOptions); err != nil {
+			log.Printf("Error restoring resource Kind: %s Name: %s Namespace: %s: %v", resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace, err)
+			failed++
+			continue
+		}
+		log.Printf("Restore Resource Kind: %s Name: %s Namespace: %s", resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace)
+		restored = append(restored, resource)
+	}
+
+	if failed > 0 {
+		return restored, fmt.Errorf("%d of %d objects failed to restore", failed, len(objects))
+	}
+	return restored, nil
+}
+
+// newClusterConfig returns a ClusterConfig for the commitID
+// applying and pruning with the options of the QueueProcessor,
+// backing up into its archive
+// and keeping the inventory in its namespace
+func (qp *QueueProcessor) newClusterConfig(commitID string) *ClusterConfig {
+	cc := NewClusterConfig(qp.repository, commitID, qp.client)
+	cc.ApplyOptions = qp.applyOptions
+	cc.PruneOptions = qp.PruneOptions
+	cc.ReplaceOnConflict = qp.ReplaceOnConflict
+	if qp.healthTimeout > 0 {
+		cc.HealthTimeout = qp.healthTimeout
+	}
+	if len(qp.hookPolicy) > 0 {
+		cc.HookDeletePolicy = qp.hookPolicy
+	}
+	if qp.archive != nil {
+		cc.Backup = qp.archive.Backup(commitID)
+	}
+	if len(qp.namespace) > 0 {
+		cc.InventoryNamespace = qp.namespace
+	}
+	return cc
 }
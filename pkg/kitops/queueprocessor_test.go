@@ -0,0 +1,512 @@
+package kitops_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/300481/kitops/pkg/kitops"
+	"github.com/300481/kitops/pkg/queue"
+)
+
+// channelNotifier sends the notifications to a channel
+type channelNotifier chan *kitops.Notification
+
+func (cn channelNotifier) Notify(n *kitops.Notification) error {
+	cn <- n
+	return nil
+}
+
+// expect fails the test if the next notification isn't the event of the commit
+func (cn channelNotifier) expect(t *testing.T, event string, commitID string) *kitops.Notification {
+	t.Helper()
+	select {
+	case n := <-cn:
+		if n.Event != event || n.CommitID != commitID {
+			t.Fatalf("got %s notification of commit %s, want %s of %s", n.Event, n.CommitID, event, commitID)
+		}
+		return n
+	case <-time.After(10 * time.Second):
+		t.Fatalf("got no %s notification of commit %s", event, commitID)
+	}
+	return nil
+}
+
+func TestAutoRollback(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{"app.yaml": appManifest},
+		map[string]string{"app.yaml": degradedManifest, "config.yaml": configManifest},
+	)
+	cluster := kitops.NewFakeCluster()
+	notifications := make(channelNotifier, 10)
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.AutoRollback = true
+	qp.Notifier = notifications
+	q := queue.New[string](qp)
+
+	q.Add(commitIDs[0], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+
+	q.Add(commitIDs[1], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventFailed, commitIDs[1])
+	n := notifications.expect(t, kitops.EventRollback, commitIDs[1])
+	if n.RollbackCommitID != commitIDs[0] {
+		t.Errorf("got rollback to %s, want %s", n.RollbackCommitID, commitIDs[0])
+	}
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := qp.ClusterConfigs[commitIDs[1]].RolledBackTo; got != commitIDs[0] {
+		t.Errorf("got failed commit rolled back to %q", got)
+	}
+	if got := qp.ClusterConfigs[commitIDs[0]].RollbackOf; got != commitIDs[1] {
+		t.Errorf("got rollback of %q", got)
+	}
+	deployments := qp.History.List()
+	if got := deployments[len(deployments)-1].Trigger; got != kitops.TriggerAutoRollback {
+		t.Errorf("got rollback triggered by %s", got)
+	}
+	for _, obj := range managedObjects(cluster) {
+		if obj.GetKind() == "ConfigMap" {
+			t.Error("ConfigMap of the failed commit was not cleaned up")
+		}
+	}
+}
+
+// notifierFunc calls the function with the notifications
+type notifierFunc func(n *kitops.Notification)
+
+func (f notifierFunc) Notify(n *kitops.Notification) error {
+	f(n)
+	return nil
+}
+
+func TestAutoRollbackPending(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		coalesce bool
+		rollback bool
+	}{
+		{name: "coalescing", coalesce: true},
+		{name: "not coalescing", rollback: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, commitIDs := newTestRepo(t,
+				map[string]string{"app.yaml": appManifest},
+				map[string]string{"app.yaml": degradedManifest},
+				map[string]string{"app.yaml": appManifest, "config.yaml": configManifest},
+			)
+			cluster := kitops.NewFakeCluster()
+			notifications := make(channelNotifier, 10)
+
+			qp := kitops.NewQueueProcessor(repo, cluster)
+			qp.AutoRollback = true
+			q := queue.New[string](qp)
+			if tc.coalesce {
+				q.Coalesce(func(string) string { return "cluster" })
+			}
+			// the fixing commit is pending when the failed one would be rolled back
+			qp.Notifier = notifierFunc(func(n *kitops.Notification) {
+				if n.Event == kitops.EventFailed && n.CommitID == commitIDs[1] {
+					q.Add(commitIDs[2], kitops.TriggerAPI)
+				}
+				notifications.Notify(n)
+			})
+
+			q.Add(commitIDs[0], kitops.TriggerAPI)
+			notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+			q.Add(commitIDs[1], kitops.TriggerAPI)
+			notifications.expect(t, kitops.EventFailed, commitIDs[1])
+			if tc.rollback {
+				notifications.expect(t, kitops.EventRollback, commitIDs[1])
+			}
+			notifications.expect(t, kitops.EventSuccessful, commitIDs[2])
+			if tc.rollback {
+				notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+			}
+			if err := q.Drain(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			rollbacks := 0
+			for _, d := range qp.History.List() {
+				if d.Trigger == kitops.TriggerAutoRollback {
+					rollbacks++
+				}
+				if d.Status == queue.Skipped {
+					t.Errorf("got commit %s skipped, want the pending commit applied", d.CommitID)
+				}
+			}
+			want, wantRollbacks := "", 0
+			if tc.rollback {
+				want, wantRollbacks = commitIDs[0], 1
+			}
+			if got := qp.ClusterConfigs[commitIDs[1]].RolledBackTo; got != want || rollbacks != wantRollbacks {
+				t.Errorf("got failed commit rolled back %d times to %q, want %q", rollbacks, got, want)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{"app.yaml": appManifest},
+		map[string]string{"app.yaml": appManifest, "config.yaml": configManifest},
+	)
+	cluster := kitops.NewFakeCluster()
+	notifications := make(channelNotifier, 10)
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.Notifier = notifications
+	q := queue.New[string](qp)
+
+	if _, err := qp.Rollback(q, commitIDs[0]); err == nil {
+		t.Error("got no error rolling back to an unknown commit")
+	}
+
+	for _, commitID := range commitIDs {
+		q.Add(commitID, kitops.TriggerAPI)
+		notifications.expect(t, kitops.EventSuccessful, commitID)
+	}
+
+	plan, err := qp.RollbackPlan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Prune) != 1 || plan.Prune[0].Kind != "ConfigMap" {
+		t.Errorf("got plan to prune %v, want the ConfigMap", plan.Prune)
+	}
+
+	rollback, err := qp.Rollback(q, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollback.CommitID != commitIDs[0] || rollback.RollbackOf != commitIDs[1] {
+		t.Errorf("got rollback %+v", rollback)
+	}
+	notifications.expect(t, kitops.EventRollback, commitIDs[1])
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+
+	if got := len(managedObjects(cluster)); got != 2 {
+		t.Errorf("got %d objects, want the Deployment and the Service", got)
+	}
+}
+
+func TestRollbackPlanAPIVersion(t *testing.T) {
+	resource := func(apiVersion string) *kitops.APIResource {
+		r := &kitops.APIResource{APIVersion: apiVersion, Kind: "Deployment"}
+		r.Metadata.Name = "app"
+		r.Metadata.Namespace = "test"
+		return r
+	}
+	qp := kitops.NewQueueProcessor(nil, kitops.NewFakeCluster())
+	qp.History.Add(&kitops.Deployment{CommitID: "1", Status: queue.Successful, Applied: true,
+		Results: []*kitops.ApplyResult{{Resource: resource("apps/v1beta1"), Action: kitops.Created}}})
+	qp.History.Add(&kitops.Deployment{CommitID: "2", Status: queue.Successful, Applied: true,
+		Results: []*kitops.ApplyResult{{Resource: resource("apps/v1"), Action: kitops.Updated}}})
+
+	plan, err := qp.RollbackPlan("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Update) != 1 || len(plan.Create) != 0 || len(plan.Prune) != 0 {
+		t.Errorf("got plan %+v, want the Deployment updated to apps/v1beta1", plan)
+	}
+}
+
+func TestProcessCanceled(t *testing.T) {
+	progressing := strings.Replace(appManifest, "replicas: 1\n", `replicas: 1
+status:
+  updatedReplicas: 0
+`, 1)
+	repo, commitIDs := newTestRepo(t, map[string]string{"app.yaml": progressing})
+	cluster := kitops.NewFakeCluster()
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.AutoRollback = true
+	q := queue.New[string](qp)
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := qp.Process(ctx, q, &queue.Item[string]{Value: commitIDs[0]}); err == nil {
+		t.Fatal("got no error processing with a canceled context")
+	}
+
+	deployments := qp.History.List()
+	if len(deployments) != 1 || deployments[0].Status != queue.Canceled {
+		t.Errorf("got deployments %+v, want the canceled commit", deployments)
+	}
+	if len(q.Pending()) > 0 {
+		t.Errorf("got %v enqueued, want no rollback of a canceled commit", q.Pending())
+	}
+}
+
+func TestStatus(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{"app.yaml": appManifest},
+		map[string]string{"app.yaml": degradedManifest},
+	)
+	cluster := kitops.NewFakeCluster()
+	notifications := make(channelNotifier, 10)
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.Notifier = notifications
+	q := queue.New[string](qp)
+
+	if status := qp.Status(q); status.Deployed != "" || status.LastFailure != nil {
+		t.Errorf("got status %+v before the first commit", status)
+	}
+
+	q.Add(commitIDs[0], kitops.TriggerAPI)
+	q.Add(commitIDs[1], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+	notifications.expect(t, kitops.EventFailed, commitIDs[1])
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	status := qp.Status(q)
+	if status.Deployed != commitIDs[1] || status.LastSuccessful != commitIDs[0] || status.InProgress != "" {
+		t.Errorf("got status %+v, want %s deployed after %s", status, commitIDs[1], commitIDs[0])
+	}
+	if status.LastFailure == nil || status.LastFailure.CommitID != commitIDs[1] || len(status.LastFailure.Error) == 0 {
+		t.Errorf("got last failure %+v, want %s with its reason", status.LastFailure, commitIDs[1])
+	}
+
+	state := qp.QueueState(q)
+	if state.Status != queue.Failed || state.InProgress != nil || len(state.Pending) != 0 {
+		t.Errorf("got queue state %+v, want the failed commit finished", state)
+	}
+	if len(state.Recent) != 2 || state.Recent[0].Status != queue.Successful || state.Recent[1].Status != queue.Failed {
+		t.Errorf("got recent outcomes %+v, want successful and failed", state.Recent)
+	}
+}
+
+func TestClusterConfigSnapshot(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{"app.yaml": appManifest},
+		map[string]string{"app.yaml": appManifest, "config.yaml": configManifest},
+		map[string]string{"config.yaml": configManifest},
+	)
+	cluster := kitops.NewFakeCluster()
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	// drop the ClusterConfig of each commit when the next one is recorded
+	qp.History = kitops.NewHistory(1)
+	q := queue.New[string](qp)
+
+	// encode the ClusterConfigs like the /clusterconfig endpoint while committing
+	done := make(chan struct{})
+	encoded := make(chan struct{})
+	go func() {
+		defer close(encoded)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := json.NewEncoder(ioutil.Discard).Encode(qp.ClusterConfigSnapshot()); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for _, commitID := range commitIDs {
+		q.Add(commitID, kitops.TriggerAPI)
+	}
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	<-encoded
+
+	snapshot := qp.ClusterConfigSnapshot()
+	if _, ok := snapshot[commitIDs[2]]; len(snapshot) != 1 || !ok {
+		t.Errorf("got ClusterConfigs %v, want the last commit", snapshot)
+	}
+}
+
+func TestPruneAbortedAlert(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{
+			"namespace.yaml": namespaceManifest,
+			"app.yaml":       appManifest,
+			"config.yaml":    configManifest,
+		},
+		map[string]string{"namespace.yaml": namespaceManifest},
+	)
+	cluster := kitops.NewFakeCluster()
+	notifications := make(channelNotifier, 10)
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.Notifier = notifications
+	qp.PruneOptions = kitops.PruneOptions{MaxPercent: 50}
+	q := queue.New[string](qp)
+
+	q.Add(commitIDs[0], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+	q.Add(commitIDs[1], kitops.TriggerAPI)
+	n := notifications.expect(t, kitops.EventPruneAborted, commitIDs[1])
+	if !strings.Contains(n.Text, "aborted") {
+		t.Errorf("got alert %q, want the reason of the abort", n.Text)
+	}
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[1])
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := qp.History.List()
+	if d := deployments[len(deployments)-1]; len(d.PruneAborted) == 0 {
+		t.Errorf("got deployment %+v, want the abort reason recorded", d)
+	}
+	if got := len(managedObjects(cluster)); got != 4 {
+		t.Errorf("got %d objects, want 4 kept", got)
+	}
+}
+
+func TestRollbackWhileProcessing(t *testing.T) {
+	progressing := strings.Replace(appManifest, "replicas: 1\n", `replicas: 1
+status:
+  updatedReplicas: 0
+`, 1)
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{"app.yaml": appManifest},
+		map[string]string{"app.yaml": appManifest, "config.yaml": configManifest},
+		map[string]string{"app.yaml": progressing},
+	)
+	cluster := kitops.NewFakeCluster()
+	notifications := make(channelNotifier, 10)
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.Notifier = notifications
+	q := queue.New[string](qp)
+	defer q.Close()
+
+	for _, commitID := range commitIDs[:2] {
+		q.Add(commitID, kitops.TriggerAPI)
+		notifications.expect(t, kitops.EventSuccessful, commitID)
+	}
+	// the last commit waits for its Deployment to become healthy
+	q.Add(commitIDs[2], kitops.TriggerAPI)
+	deadline := time.Now().Add(10 * time.Second)
+	for item := q.InProgress(); item == nil || item.Value != commitIDs[2]; item = q.InProgress() {
+		if time.Now().After(deadline) {
+			t.Fatal("last commit was not processed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		plan, err := qp.RollbackPlan(commitIDs[0])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(plan.Prune) != 1 || plan.Prune[0].Kind != "ConfigMap" || len(plan.Update) != 2 {
+			t.Errorf("got plan to update %v and prune %v, want the ConfigMap pruned", plan.Update, plan.Prune)
+		}
+		if _, err := qp.Rollback(q, commitIDs[0]); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("rollback waited for the commit in progress")
+	}
+	notifications.expect(t, kitops.EventRollback, commitIDs[1])
+
+	if pending := q.Pending(); len(pending) != 1 || pending[0].Value != commitIDs[0] || pending[0].Trigger != kitops.TriggerRollback {
+		t.Errorf("got pending %v, want the rollback", pending)
+	}
+}
+
+func TestStatusDeployed(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		deployments []*kitops.Deployment
+		want        string
+	}{
+		{name: "canceled", deployments: []*kitops.Deployment{
+			{CommitID: "1", Status: queue.Successful},
+			{CommitID: "2", Status: queue.Canceled},
+		}, want: "1"},
+		{name: "retrying", deployments: []*kitops.Deployment{
+			{CommitID: "1", Status: queue.Successful},
+			{CommitID: "2", Status: queue.Retrying},
+		}, want: "1"},
+		{name: "rolled back", deployments: []*kitops.Deployment{
+			{CommitID: "1", Status: queue.Successful},
+			{CommitID: "2", Status: queue.Failed, RolledBackTo: "1"},
+		}, want: "1"},
+		{name: "failed", deployments: []*kitops.Deployment{
+			{CommitID: "1", Status: queue.Successful},
+			{CommitID: "2", Status: queue.Retrying},
+			{CommitID: "2", Status: queue.Failed, Applied: true},
+		}, want: "2"},
+		{name: "failed before applying", deployments: []*kitops.Deployment{
+			{CommitID: "1", Status: queue.Successful, Applied: true},
+			{CommitID: "2", Status: queue.Failed},
+		}, want: "1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			qp := kitops.NewQueueProcessor(nil, kitops.NewFakeCluster())
+			for _, d := range tc.deployments {
+				qp.History.Add(d)
+			}
+			q := queue.New[string](qp)
+			defer q.Close()
+
+			if status := qp.Status(q); status.Deployed != tc.want || status.LastSuccessful != "1" {
+				t.Errorf("got status %+v, want %s deployed after 1", status, tc.want)
+			}
+		})
+	}
+}
+
+func TestStatusNotApplied(t *testing.T) {
+	repo, commitIDs := newTestRepo(t,
+		map[string]string{"app.yaml": appManifest},
+		map[string]string{
+			"app.yaml":  appManifest,
+			"hook.yaml": fmt.Sprintf(hookManifest, "PreSync") + failedStatus,
+		},
+	)
+	cluster := kitops.NewFakeCluster()
+	notifications := make(channelNotifier, 10)
+
+	qp := kitops.NewQueueProcessor(repo, cluster)
+	qp.Notifier = notifications
+	q := queue.New[string](qp)
+	defer q.Close()
+
+	q.Add(commitIDs[0], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventSuccessful, commitIDs[0])
+
+	// the pre-sync hook fails before the resources are applied
+	q.Add(commitIDs[1], kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventFailed, commitIDs[1])
+	if status := qp.Status(q); status.Deployed != commitIDs[0] {
+		t.Errorf("got %s deployed after the failed pre-sync hook, want %s", status.Deployed, commitIDs[0])
+	}
+
+	// the commit can't be checked out
+	unknown := strings.Repeat("f", 40)
+	q.Add(unknown, kitops.TriggerAPI)
+	notifications.expect(t, kitops.EventFailed, unknown)
+	if status := qp.Status(q); status.Deployed != commitIDs[0] || status.LastFailure.CommitID != unknown {
+		t.Errorf("got status %+v after the failed checkout, want %s deployed", status, commitIDs[0])
+	}
+}
@@ -0,0 +1,51 @@
+package kitops
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// replaceAnnotation set to "true" replaces a resource,
+	// if applying it fails with changed immutable fields
+	replaceAnnotation = "kitops.io/replace-on-conflict"
+)
+
+// immutableFieldError returns a bool if the error rejects
+// changing immutable fields of an object
+func immutableFieldError(err error) bool {
+	return errors.IsInvalid(err) && strings.Contains(err.Error(), "field is immutable")
+}
+
+// replaceable returns a bool if the object with the checksum may be replaced
+// on changed immutable fields
+func (c *Collection) replaceable(checksum string) bool {
+	return c.replaceOnConflict || c.objects[checksum].GetAnnotations()[replaceAnnotation] == "true"
+}
+
+// replace deletes the object with the checksum, waits until it is gone
+// and applies it again. A dry run only returns the action.
+// returns an error if it can't be replaced
+func (c *Collection) replace(ctx context.Context, checksum string, opts ApplyOptions) (ApplyAction, error) {
+	if opts.DryRun {
+		return Replaced, nil
+	}
+
+	resource := c.Items[checksum]
+	log.Printf("Replace Resource with changed immutable fields Kind: %s Name: %s Namespace: %s", resource.Kind, resource.Metadata.Name, resource.Metadata.Namespace)
+	if err := resource.Delete(c.client, DeleteOptions{Propagation: metav1.DeletePropagationForeground}); err != nil {
+		return "", err
+	}
+	if err := resource.waitForDeleted(ctx, c.client, c.healthTimeout); err != nil {
+		return "", err
+	}
+
+	if _, _, err := c.client.Apply(c.objects[checksum], opts); err != nil {
+		return "", err
+	}
+	return Replaced, nil
+}
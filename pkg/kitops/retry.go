@@ -0,0 +1,99 @@
+package kitops
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/300481/kitops/pkg/queue"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// TriggerRedrive is the trigger of failed commits enqueued again
+	TriggerRedrive = "Redrive"
+
+	defaultRetryMaxAttempts = 3
+	defaultRetryBackoff     = 10 * time.Second
+	defaultRetryMaxBackoff  = 5 * time.Minute
+	retryJitter             = 0.2
+)
+
+// CheckoutError is returned if the commit can't be checked out of the repository
+type CheckoutError struct {
+	CommitID string
+	Err      error
+}
+
+func (e *CheckoutError) Error() string {
+	return fmt.Sprintf("checkout of commit %s failed: %v", e.CommitID, e.Err)
+}
+
+func (e *CheckoutError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyError is returned if resources of the commit failed to apply
+type ApplyError struct {
+	CommitID string
+	Errors   []error
+}
+
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("%d errors applying the resources of commit %s", len(e.Errors), e.CommitID)
+}
+
+// Retryable returns true if applying a commit failed with the error may
+// succeed when applied again: if the checkout failed or the API server
+// was unavailable, timed out or throttled the requests.
+// Invalid manifests and unhealthy resources aren't retryable.
+func Retryable(err error) bool {
+	var checkoutErr *CheckoutError
+	if errors.As(err, &checkoutErr) {
+		return true
+	}
+
+	var applyErr *ApplyError
+	if errors.As(err, &applyErr) {
+		for _, err := range applyErr.Errors {
+			if Retryable(err) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		err := status.(error)
+		return apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+			apierrors.IsTooManyRequests(err) || apierrors.IsServiceUnavailable(err) ||
+			apierrors.IsInternalError(err)
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// newRetryPolicy returns the retry policy of the commits configured by the environment
+func newRetryPolicy() *queue.RetryPolicy {
+	policy := &queue.RetryPolicy{
+		MaxAttempts: defaultRetryMaxAttempts,
+		Backoff:     defaultRetryBackoff,
+		MaxBackoff:  defaultRetryMaxBackoff,
+		Jitter:      retryJitter,
+		Retryable:   Retryable,
+	}
+	if len(os.Getenv("KITOPS_RETRY_MAX_ATTEMPTS")) > 0 {
+		policy.MaxAttempts = intEnv("KITOPS_RETRY_MAX_ATTEMPTS")
+	}
+	if d := durationEnv("KITOPS_RETRY_BACKOFF"); d > 0 {
+		policy.Backoff = d
+	}
+	if d := durationEnv("KITOPS_RETRY_MAX_BACKOFF"); d > 0 {
+		policy.MaxBackoff = d
+	}
+	return policy
+}
@@ -0,0 +1,32 @@
+package kitops_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/300481/kitops/pkg/kitops"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRetryable(t *testing.T) {
+	timeout := apierrors.NewServerTimeout(schema.GroupResource{Resource: "deployments"}, "apply", 1)
+	invalid := apierrors.NewBadRequest("invalid manifest")
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"checkout", &kitops.CheckoutError{CommitID: "c", Err: errors.New("timeout")}, true},
+		{"server timeout", fmt.Errorf("Kind: Deployment: %w", timeout), true},
+		{"bad request", invalid, false},
+		{"apply with a server timeout", &kitops.ApplyError{CommitID: "c", Errors: []error{invalid, timeout}}, true},
+		{"apply without transient errors", &kitops.ApplyError{CommitID: "c", Errors: []error{invalid}}, false},
+		{"unhealthy", errors.New("resources not healthy"), false},
+	} {
+		if got := kitops.Retryable(tc.err); got != tc.want {
+			t.Errorf("%s: got retryable %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
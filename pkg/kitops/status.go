@@ -0,0 +1,117 @@
+package kitops
+
+import (
+	"time"
+
+	"github.com/300481/kitops/pkg/queue"
+)
+
+const (
+	// recentOutcomes is the number of processed commits in the QueueState
+	recentOutcomes = 10
+)
+
+// QueueState is the state of the queue of commits
+type QueueState struct {
+	Status queue.Status
+	// InProgress is the commit being applied, nil if none
+	InProgress *queue.Item[string]
+	// Pending are the commits waiting to be applied in their order
+	Pending []*queue.Item[string]
+	// Recent are the outcomes of the last processed commits, the oldest first
+	Recent []*Outcome
+}
+
+// Outcome is the short record of a processed commit
+type Outcome struct {
+	CommitID string
+	Trigger  string
+	Status   queue.Status
+	Attempts int
+	Finished time.Time
+	Error    string `json:",omitempty"`
+	// PruneAborted holds the reason if the cleanup was aborted
+	PruneAborted string `json:",omitempty"`
+}
+
+// Status summarizes the commits applied to the cluster
+type Status struct {
+	// Deployed is the commit applied last, successful or failed after applying resources without rollback
+	Deployed string
+	// LastSuccessful is the commit applied successfully last
+	LastSuccessful string
+	// LastFailure is the outcome of the commit failed last, nil if none
+	LastFailure *Outcome `json:",omitempty"`
+	// InProgress is the commit being applied, empty if none
+	InProgress string `json:",omitempty"`
+}
+
+// newOutcome returns the Outcome of the Deployment
+func newOutcome(d *Deployment) *Outcome {
+	return &Outcome{
+		CommitID:     d.CommitID,
+		Trigger:      d.Trigger,
+		Status:       d.Status,
+		Attempts:     d.Attempts,
+		Finished:     d.Finished,
+		Error:        d.Error,
+		PruneAborted: d.PruneAborted,
+	}
+}
+
+// QueueState returns the state of the queue q with the outcomes
+// of the recently processed commits of the history
+func (qp *QueueProcessor) QueueState(q *queue.Queue[string]) *QueueState {
+	state := &QueueState{
+		Status:     q.Status(),
+		InProgress: q.InProgress(),
+		Pending:    q.Pending(),
+		Recent:     []*Outcome{},
+	}
+
+	deployments := qp.History.List()
+	if len(deployments) > recentOutcomes {
+		deployments = deployments[len(deployments)-recentOutcomes:]
+	}
+	for _, d := range deployments {
+		state.Recent = append(state.Recent, newOutcome(d))
+	}
+	return state
+}
+
+// Status returns the Status of the commits of the history
+// and the commit in progress of the queue q.
+// Skipped, canceled and retried commits, the failed ones rolled back
+// and the ones failed before any resource was applied aren't deployed.
+func (qp *QueueProcessor) Status(q *queue.Queue[string]) *Status {
+	status := &Status{}
+	if item := q.InProgress(); item != nil {
+		status.InProgress = item.Value
+	}
+
+	deployments := qp.History.List()
+	for i := len(deployments) - 1; i >= 0; i-- {
+		d := deployments[i]
+		if len(status.Deployed) == 0 && deployed(d) {
+			status.Deployed = d.CommitID
+		}
+		if len(status.LastSuccessful) == 0 && d.Status == queue.Successful {
+			status.LastSuccessful = d.CommitID
+		}
+		if status.LastFailure == nil && d.Status == queue.Failed {
+			status.LastFailure = newOutcome(d)
+		}
+	}
+	return status
+}
+
+// deployed returns true if the deployment left its commit applied
+func deployed(d *Deployment) bool {
+	switch d.Status {
+	case queue.Successful:
+		return true
+	case queue.Failed:
+		return d.Applied && len(d.RolledBackTo) == 0
+	}
+	return false
+}
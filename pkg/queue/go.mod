@@ -1,3 +1,3 @@
 module github.com/300481/kitops/pkg/queue
 
-go 1.14
+go 1.18
@@ -0,0 +1,211 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operations of journal records
+const (
+	opAdd    = "add"
+	opStart  = "start"
+	opFinish = "finish"
+)
+
+// record is a line of the journal
+type record[T any] struct {
+	Op       string    `json:"op"`
+	ID       uint64    `json:"id"`
+	Value    T         `json:"value,omitempty"`
+	Enqueued time.Time `json:"enqueued,omitempty"`
+	Trigger  string    `json:"trigger,omitempty"`
+	Success  bool      `json:"success,omitempty"`
+}
+
+// journal is an append-only file recording the items added to,
+// started and finished by the queue
+type journal[T any] struct {
+	path   string
+	file   *os.File
+	nextID uint64
+	// open holds the records of the items added, but not finished
+	open map[uint64]*record[T]
+	mux  sync.Mutex
+}
+
+// openJournal opens the journal at path, creating it if it doesn't exist
+// returns the items not finished, the ones started first,
+// and an error if the journal can't be opened or written
+func openJournal[T any](path string) (*journal[T], []*Item[T], error) {
+	j := &journal[T]{
+		path:   path,
+		nextID: 1,
+		open:   make(map[uint64]*record[T]),
+	}
+
+	attempts, err := j.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ids []uint64
+	for id := range j.open {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		if (attempts[ids[a]] > 0) != (attempts[ids[b]] > 0) {
+			return attempts[ids[a]] > 0
+		}
+		return ids[a] < ids[b]
+	})
+
+	var items []*Item[T]
+	for _, id := range ids {
+		r := j.open[id]
+		items = append(items, &Item[T]{
+			Value:    r.Value,
+			Enqueued: r.Enqueued,
+			Trigger:  r.Trigger,
+			Attempts: attempts[id],
+			ID:       id,
+		})
+	}
+
+	// compact the journal to the records of the restored items
+	if err := j.rewrite(attempts); err != nil {
+		return nil, nil, err
+	}
+	return j, items, nil
+}
+
+// replay reads the records of the journal into the open items
+// A truncated last record of an interrupted write is ignored.
+// returns the number of starts of the open items
+func (j *journal[T]) replay() (map[uint64]int, error) {
+	attempts := make(map[uint64]int)
+
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return attempts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r record[T]
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			break
+		}
+		if r.ID >= j.nextID {
+			j.nextID = r.ID + 1
+		}
+
+		switch r.Op {
+		case opAdd:
+			j.open[r.ID] = &r
+		case opStart:
+			attempts[r.ID]++
+		case opFinish:
+			delete(j.open, r.ID)
+			delete(attempts, r.ID)
+		}
+	}
+	return attempts, nil
+}
+
+// rewrite replaces the journal by the add records of the open items
+// followed by a start record per attempt
+func (j *journal[T]) rewrite(attempts map[uint64]int) error {
+	var ids []uint64
+	for id := range j.open {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+
+	tmp := j.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file)
+	for _, id := range ids {
+		if err := enc.Encode(j.open[id]); err != nil {
+			file.Close()
+			return err
+		}
+		for i := 0; i < attempts[id]; i++ {
+			if err := enc.Encode(&record[T]{Op: opStart, ID: id}); err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+// add records the new item
+func (j *journal[T]) add(it *Item[T]) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	r := &record[T]{Op: opAdd, ID: it.ID, Value: it.Value, Enqueued: it.Enqueued, Trigger: it.Trigger}
+	j.open[r.ID] = r
+	return j.append(r)
+}
+
+// start records the start of processing the item
+func (j *journal[T]) start(it *Item[T]) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	return j.append(&record[T]{Op: opStart, ID: it.ID})
+}
+
+// finish records the end of processing the item
+// The journal is truncated as soon as all items are finished.
+func (j *journal[T]) finish(it *Item[T], success bool) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	delete(j.open, it.ID)
+	if len(j.open) == 0 {
+		return j.rewrite(nil)
+	}
+	return j.append(&record[T]{Op: opFinish, ID: it.ID, Success: success})
+}
+
+// append writes the record to the end of the journal and syncs it to disk
+// It must be called with the mutex locked.
+func (j *journal[T]) append(r *record[T]) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
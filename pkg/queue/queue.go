@@ -2,11 +2,29 @@ package queue
 
 import (
 	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 )
 
-type Consumer interface {
-	Process(q *Queue)
+// ErrClosed is returned when adding elements to a closed queue
+var ErrClosed = errors.New("queue is closed")
+
+// Consumer processes the items of a Queue
+type Consumer[T any] interface {
+	// Process processes the item of the queue q. The context is canceled
+	// by CancelCurrent and Close. The item is successful without an error.
+	Process(ctx context.Context, q *Queue[T], item *Item[T]) error
+}
+
+// SkipConsumer is a Consumer recording the items skipped by a coalescing queue
+type SkipConsumer[T any] interface {
+	Consumer[T]
+	// Skip is called with each item superseded by a newer one
+	Skip(item *Item[T])
 }
 
 type Status string
@@ -16,81 +34,498 @@ const (
 	InProgress Status = "InProgress"
 	Failed     Status = "Failed"
 	Successful Status = "Successful"
+	// Skipped items were superseded by newer ones of a coalescing queue
+	Skipped Status = "Skipped"
+	// Canceled items were canceled while in progress
+	Canceled Status = "Canceled"
+	// Retrying items failed and wait to be processed again
+	Retrying Status = "Retrying"
 )
 
-type Queue struct {
+// Item is an element of the queue with its metadata
+type Item[T any] struct {
+	Value T
+	// Enqueued is the time the item was added
+	Enqueued time.Time
+	// Trigger is the source adding the item
+	Trigger string
+	// Attempts is the number of times processing the item was started
+	Attempts int
+	// Started is the time the last attempt was started
+	Started *time.Time `json:",omitempty"`
+	// ID identifies the item in the queue and its journal
+	ID uint64
+	// Retry overrides the retry policy of the queue for the item
+	Retry *RetryPolicy `json:"-"`
+}
+
+// Queue processes its items one after another in the order they were added
+// by a single worker calling the consumer
+type Queue[T any] struct {
 	list           *list.List
-	current        interface{}
-	previous       interface{}
-	lastSuccessful interface{}
+	current        *Item[T]
+	previous       *Item[T]
+	lastSuccessful *Item[T]
 	status         Status
-	mux            *sync.Mutex
-	consumer       Consumer
+	// mux guards the fields of the queue
+	mux sync.Mutex
+	// cond signals the worker added items and closing the queue
+	cond     *sync.Cond
+	consumer Consumer[T]
+	// journal records the items to restore them after a restart, nil if not durable
+	journal *journal[T]
+	// key returns the target of a value of a coalescing queue, nil if not coalescing
+	key func(v T) string
+	// retry is the retry policy of the items, nil doesn't retry
+	retry *RetryPolicy
+	// deadLetters holds the items failed permanently, the oldest first
+	deadLetters []*DeadLetter[T]
+	nextID      uint64
+	// ctx is canceled by Close, cancelCurrent cancels processing the current item
+	ctx           context.Context
+	cancel        context.CancelFunc
+	cancelCurrent context.CancelFunc
+	// closed queues accept no more items, stopped ones process no more
+	closed  bool
+	stopped bool
+	// done is closed when the worker returned
+	done chan struct{}
+}
+
+// New creates a new Queue, starts its worker and returns *Queue.
+func New[T any](consumer Consumer[T]) *Queue[T] {
+	q := newQueue(consumer)
+	go q.run()
+	return q
+}
+
+// NewDurable creates a new Queue journaling its items in the file at path,
+// starts its worker and returns *Queue. The items not finished before,
+// the ones in progress first, are restored from the journal and processed
+// again, so processing them must be idempotent. The values must be
+// encodable as JSON.
+// returns an error if the journal can't be opened
+func NewDurable[T any](consumer Consumer[T], path string) (*Queue[T], error) {
+	j, items, err := openJournal[T](path)
+	if err != nil {
+		return nil, err
+	}
+
+	q := newQueue(consumer)
+	q.journal = j
+	q.nextID = j.nextID
+	for _, it := range items {
+		q.list.PushBack(it)
+	}
+	go q.run()
+	return q, nil
 }
 
-// New creates a new Queue and returns *Queue.
-func New(consumer Consumer) *Queue {
-	return &Queue{
-		list:           list.New(),
-		current:        nil,
-		previous:       nil,
-		lastSuccessful: nil,
-		status:         Init,
-		mux:            &sync.Mutex{},
-		consumer:       consumer,
+// newQueue returns an initialized *Queue without starting the worker
+func newQueue[T any](consumer Consumer[T]) *Queue[T] {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue[T]{
+		list:     list.New(),
+		status:   Init,
+		consumer: consumer,
+		nextID:   1,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
 	}
+	q.cond = sync.NewCond(&q.mux)
+	return q
+}
+
+// Coalesce makes the queue coalescing: an added item supersedes the
+// pending items with the same key, which are skipped. If the consumer is
+// a SkipConsumer, it is called with the skipped items.
+func (q *Queue[T]) Coalesce(key func(v T) string) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.key = key
 }
 
-// Add adds a new commit string as element to the Queue and initiate a threaded processing.
-func (q *Queue) Add(v interface{}) {
-	q.list.PushBack(v)
-	go q.consumer.Process(q)
+// Retry sets the retry policy of the items failed to process
+func (q *Queue[T]) Retry(policy *RetryPolicy) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.retry = policy
+}
+
+// Add adds a new item with the value to the end of the Queue.
+// trigger is the source adding it.
+// returns ErrClosed if the queue is closed
+func (q *Queue[T]) Add(v T, trigger string) error {
+	return q.AddItem(&Item[T]{Value: v, Trigger: trigger})
+}
+
+// AddItem adds the item with its Value, Trigger and Retry policy
+// to the end of the Queue. The other fields are set by the queue.
+// returns ErrClosed if the queue is closed
+func (q *Queue[T]) AddItem(it *Item[T]) error {
+	q.mux.Lock()
+	if q.closed {
+		q.mux.Unlock()
+		return ErrClosed
+	}
+
+	it.Enqueued = time.Now()
+	it.Attempts = 0
+	it.Started = nil
+	it.ID = q.nextID
+	q.nextID++
+	if q.journal != nil {
+		if err := q.journal.add(it); err != nil {
+			log.Printf("Error journaling queue item %v: %v", it.Value, err)
+		}
+	}
+	skipped := q.supersede(it.Value)
+	q.list.PushBack(it)
+	q.cond.Signal()
+	q.mux.Unlock()
+
+	for _, s := range skipped {
+		q.skip(s)
+	}
+	return nil
 }
 
-// StartNext returns the next element in the queue and clean the queue by one.
-// It also Locks a Mutex.
-// Must be finalized with Finish() to unlock the mutex.
-func (q *Queue) StartNext() interface{} {
-	if q.list.Len() == 0 {
+// supersede removes the pending items with the key of v from a coalescing queue
+// returns the removed items
+// It must be called with the mutex locked.
+func (q *Queue[T]) supersede(v T) []*Item[T] {
+	if q.key == nil {
 		return nil
 	}
 
+	var skipped []*Item[T]
+	key := q.key(v)
+	for e := q.list.Front(); e != nil; {
+		next := e.Next()
+		if it := e.Value.(*Item[T]); q.key(it.Value) == key {
+			q.list.Remove(e)
+			skipped = append(skipped, it)
+		}
+		e = next
+	}
+	return skipped
+}
+
+// skip finishes the superseded item in the journal and passes it to the consumer
+// The consumer is called asynchronously, since Add may be called while processing.
+func (q *Queue[T]) skip(it *Item[T]) {
+	log.Printf("Skip queue item %v, it is superseded", it.Value)
+	if q.journal != nil {
+		if err := q.journal.finish(it, false); err != nil {
+			log.Printf("Error journaling skip of queue item %v: %v", it.Value, err)
+		}
+	}
+	if sc, ok := q.consumer.(SkipConsumer[T]); ok {
+		go sc.Skip(it)
+	}
+}
+
+// run is the worker processing the items until the queue is stopped
+// or closed and empty
+func (q *Queue[T]) run() {
+	defer close(q.done)
+
+	for {
+		it, ctx, ok := q.next()
+		if !ok {
+			return
+		}
+		err := q.process(ctx, it)
+		q.finish(it, ctx, err)
+	}
+}
+
+// process processes the item, again after the backoff of its retry policy
+// as long as it fails with retryable errors
+func (q *Queue[T]) process(ctx context.Context, it *Item[T]) error {
+	for {
+		err := q.consumer.Process(ctx, q, it)
+		if err == nil || ctx.Err() != nil || !q.WillRetry(it, err) {
+			return err
+		}
+
+		delay := q.policy(it).backoff(it.Attempts)
+		log.Printf("Retry queue item %v in %s after attempt %d failed: %v", it.Value, delay, it.Attempts, err)
+		q.setStatus(Retrying)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		q.restart(it)
+	}
+}
+
+// WillRetry returns true if the current item failed with the error
+// is processed again by the queue
+func (q *Queue[T]) WillRetry(it *Item[T], err error) bool {
+	return q.policy(it).retry(it.Attempts, err)
+}
+
+// policy returns the retry policy of the item
+func (q *Queue[T]) policy(it *Item[T]) *RetryPolicy {
+	if it.Retry != nil {
+		return it.Retry
+	}
 	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return q.retry
+}
+
+// setStatus sets the status of the current item
+func (q *Queue[T]) setStatus(status Status) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.status = status
+}
+
+// restart starts another attempt processing the current item
+func (q *Queue[T]) restart(it *Item[T]) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	it.Attempts++
+	started := time.Now()
+	it.Started = &started
+	q.status = InProgress
+	if q.journal != nil {
+		if err := q.journal.start(it); err != nil {
+			log.Printf("Error journaling start of queue item %v: %v", it.Value, err)
+		}
+	}
+}
+
+// next waits for the next item and makes it the current one
+// returns the item, the context of processing it
+// and false if the worker has to return
+func (q *Queue[T]) next() (*Item[T], context.Context, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	for q.list.Len() == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.stopped || q.list.Len() == 0 {
+		return nil, nil, false
+	}
+
+	front := q.list.Front()
+	q.list.Remove(front)
+	it := front.Value.(*Item[T])
+	it.Attempts++
+	started := time.Now()
+	it.Started = &started
+
 	q.previous = q.current
-	q.current = q.list.Front().Value
-	q.list.Remove(q.list.Front())
+	q.current = it
 	q.status = InProgress
+	if q.journal != nil {
+		if err := q.journal.start(it); err != nil {
+			log.Printf("Error journaling start of queue item %v: %v", it.Value, err)
+		}
+	}
 
-	return q.current
+	ctx, cancel := context.WithCancel(q.ctx)
+	q.cancelCurrent = cancel
+	return it, ctx, true
 }
 
-// Finish finishes the current element processing of the queue and unlock the mutex.
-func (q *Queue) Finish(success bool) {
-	if success {
+// finish records the status of the processed item
+// An item interrupted by closing the queue stays in the journal
+// to be processed again after a restart.
+func (q *Queue[T]) finish(it *Item[T], ctx context.Context, err error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	canceled := ctx.Err() != nil
+	q.cancelCurrent()
+	q.cancelCurrent = nil
+
+	switch {
+	case err == nil:
 		q.status = Successful
-		q.lastSuccessful = q.current
-	} else {
+		q.lastSuccessful = it
+	case canceled:
+		q.status = Canceled
+	default:
 		q.status = Failed
+		q.deadLetters = append(q.deadLetters, &DeadLetter[T]{Item: it, Error: err.Error(), Failed: time.Now()})
+		if len(q.deadLetters) > maxDeadLetters {
+			q.deadLetters = q.deadLetters[len(q.deadLetters)-maxDeadLetters:]
+		}
 	}
+
+	if q.journal != nil && !(canceled && q.stopped) {
+		if err := q.journal.finish(it, err == nil); err != nil {
+			log.Printf("Error journaling finish of queue item %v: %v", it.Value, err)
+		}
+	}
+}
+
+// CancelCurrent cancels the context of the item in progress
+// returns false if no item is in progress
+func (q *Queue[T]) CancelCurrent() bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.cancelCurrent == nil {
+		return false
+	}
+	q.cancelCurrent()
+	return true
+}
+
+// Close stops accepting items, cancels the item in progress
+// and waits for the worker to return. The pending items aren't processed.
+func (q *Queue[T]) Close() {
+	q.mux.Lock()
+	q.closed = true
+	q.stopped = true
+	q.cancel()
+	q.cond.Broadcast()
+	q.mux.Unlock()
+
+	<-q.done
+}
+
+// Drain stops accepting items and waits until all pending items are
+// processed. If the context is done before, the queue is closed.
+// returns the error of the context if the queue wasn't drained
+func (q *Queue[T]) Drain(ctx context.Context) error {
+	q.mux.Lock()
+	q.closed = true
+	q.cond.Broadcast()
 	q.mux.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		q.Close()
+		return ctx.Err()
+	}
 }
 
-// Current returns the current element
-func (q *Queue) Current() interface{} {
+// Current returns the current item or nil before the first one
+func (q *Queue[T]) Current() *Item[T] {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
 	return q.current
 }
 
-// Previous returns the previous element
-func (q *Queue) Previous() interface{} {
+// Previous returns the previous item or nil
+func (q *Queue[T]) Previous() *Item[T] {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
 	return q.previous
 }
 
-// LastSuccessful returns the last successful processed element
-func (q *Queue) LastSuccessful() interface{} {
+// LastSuccessful returns the last successful processed item or nil
+func (q *Queue[T]) LastSuccessful() *Item[T] {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
 	return q.lastSuccessful
 }
 
-// Status returns the status of the current processed element
-func (q *Queue) Status() Status {
+// Status returns the status of the current processed item
+func (q *Queue[T]) Status() Status {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
 	return q.status
 }
+
+// InProgress returns a copy of the item being processed or waiting
+// to be retried, nil if no item is in progress
+func (q *Queue[T]) InProgress() *Item[T] {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.cancelCurrent == nil {
+		return nil
+	}
+	it := *q.current
+	return &it
+}
+
+// Pending returns copies of the items waiting to be processed in their order
+func (q *Queue[T]) Pending() []*Item[T] {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	pending := make([]*Item[T], 0, q.list.Len())
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		it := *e.Value.(*Item[T])
+		pending = append(pending, &it)
+	}
+	return pending
+}
+
+// Superseded returns true if a pending item supersedes v in a coalescing queue
+func (q *Queue[T]) Superseded(v T) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.key == nil {
+		return false
+	}
+	key := q.key(v)
+	for e := q.list.Front(); e != nil; e = e.Next() {
+		if q.key(e.Value.(*Item[T]).Value) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// DeadLetters returns the items failed permanently, the oldest first
+func (q *Queue[T]) DeadLetters() []*DeadLetter[T] {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return append([]*DeadLetter[T](nil), q.deadLetters...)
+}
+
+// Redrive removes the dead letter of the item with the id and adds its
+// value again with its retry policy. trigger is the source adding it.
+// returns the added item and an error if there is no such dead letter
+// or the queue is closed
+func (q *Queue[T]) Redrive(id uint64, trigger string) (*Item[T], error) {
+	q.mux.Lock()
+	var dl *DeadLetter[T]
+	for i, d := range q.deadLetters {
+		if d.Item.ID == id {
+			dl = d
+			q.deadLetters = append(q.deadLetters[:i:i], q.deadLetters[i+1:]...)
+			break
+		}
+	}
+	q.mux.Unlock()
+	if dl == nil {
+		return nil, fmt.Errorf("no dead letter of queue item %d", id)
+	}
+
+	it := &Item[T]{Value: dl.Item.Value, Trigger: trigger, Retry: dl.Item.Retry}
+	if err := q.AddItem(it); err != nil {
+		q.mux.Lock()
+		q.deadLetters = append(q.deadLetters, dl)
+		q.mux.Unlock()
+		return nil, err
+	}
+	return it, nil
+}
@@ -1,7 +1,13 @@
 package queue_test
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,25 +16,315 @@ import (
 
 const Value string = "Test"
 
-var ReturnedValues []string
+// recordingConsumer sends the processed items to a channel
+type recordingConsumer chan *queue.Item[string]
 
-type TestStruct struct{}
+func (rc recordingConsumer) Process(ctx context.Context, q *queue.Queue[string], item *queue.Item[string]) error {
+	rc <- item
+	return nil
+}
+
+// expect fails the test if the next processed items aren't the wanted ones
+// returns the processed items
+func (rc recordingConsumer) expect(t *testing.T, want ...string) []*queue.Item[string] {
+	t.Helper()
+	var items []*queue.Item[string]
+	for _, w := range want {
+		select {
+		case got := <-rc:
+			if got.Value != w {
+				t.Errorf("got %s, want %s", got.Value, w)
+			}
+			items = append(items, got)
+		case <-time.After(time.Second):
+			t.Fatalf("%s was not processed", w)
+		}
+	}
+	return items
+}
 
-func (t *TestStruct) Process(q *queue.Queue) {
-	ReturnedValues = append(ReturnedValues, q.StartNext().(string))
-	q.Finish(true)
+// gatedConsumer processes an element when the gate is opened or its context
+// is canceled and records the started, processed and skipped elements
+type gatedConsumer struct {
+	gate      chan struct{}
+	started   chan string
+	processed chan string
+	skipped   chan string
+}
+
+func newGatedConsumer() *gatedConsumer {
+	return &gatedConsumer{
+		gate:      make(chan struct{}),
+		started:   make(chan string, 4),
+		processed: make(chan string, 4),
+		skipped:   make(chan string, 4),
+	}
+}
+
+func (gc *gatedConsumer) Process(ctx context.Context, q *queue.Queue[string], item *queue.Item[string]) error {
+	gc.started <- item.Value
+	select {
+	case <-gc.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	gc.processed <- item.Value
+	return nil
+}
+
+func (gc *gatedConsumer) Skip(item *queue.Item[string]) {
+	gc.skipped <- item.Value
 }
 
 func TestNew(t *testing.T) {
-	ts := &TestStruct{}
-	q := queue.New(ts)
+	processed := make(recordingConsumer, 10)
+	q := queue.New[string](processed)
+	defer q.Close()
+
+	var want []string
 	for i := 0; i < 10; i++ {
-		q.Add(Value + strconv.Itoa(i))
+		q.Add(Value+strconv.Itoa(i), "test")
+		want = append(want, Value+strconv.Itoa(i))
 	}
-	time.Sleep(time.Second)
-	for i := 0; i < 10; i++ {
-		if Value+strconv.Itoa(i) != ReturnedValues[i] {
-			t.Errorf("got %s, want %s", ReturnedValues[i], Value+strconv.Itoa(i))
+	processed.expect(t, want...)
+}
+
+func TestStatus(t *testing.T) {
+	gc := newGatedConsumer()
+	q := queue.New[string](gc)
+	defer q.Close()
+
+	q.Add("first", "test")
+	<-gc.started
+	q.Add("second", "test")
+	if q.Status() != queue.InProgress || q.Current().Value != "first" {
+		t.Errorf("got %s %v, want first in progress", q.Status(), q.Current())
+	}
+	if it := q.InProgress(); it == nil || it.Value != "first" || it.Started == nil {
+		t.Errorf("got %v in progress, want first started", it)
+	}
+	if pending := q.Pending(); len(pending) != 1 || pending[0].Value != "second" || pending[0].Trigger != "test" || pending[0].Enqueued.IsZero() || pending[0].Started != nil {
+		t.Errorf("got pending %v, want second", pending)
+	}
+
+	close(gc.gate)
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if it := q.InProgress(); it != nil {
+		t.Errorf("got %v in progress after draining", it)
+	}
+	if q.Status() != queue.Successful || q.Current().Value != "second" || q.Previous().Value != "first" || q.LastSuccessful().Value != "second" {
+		t.Errorf("got %s %v after %v, want second successful", q.Status(), q.Current(), q.Previous())
+	}
+	if err := q.Add("third", "test"); !errors.Is(err, queue.ErrClosed) {
+		t.Errorf("got %v adding to a drained queue, want %v", err, queue.ErrClosed)
+	}
+}
+
+func TestCancelCurrent(t *testing.T) {
+	gc := newGatedConsumer()
+	q := queue.New[string](gc)
+	defer q.Close()
+
+	q.Add("first", "test")
+	<-gc.started
+	q.Add("second", "test")
+	if !q.CancelCurrent() {
+		t.Fatal("got no element in progress")
+	}
+	<-gc.started
+	if q.Current().Value != "second" || q.Previous().Value != "first" {
+		t.Errorf("got %v after %v, want second after first", q.Current(), q.Previous())
+	}
+	if q.LastSuccessful() != nil {
+		t.Errorf("got %v successful, want the canceled element not", q.LastSuccessful())
+	}
+}
+
+func TestDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	gc := newGatedConsumer()
+	q, err := queue.NewDurable[string](gc, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Add("first", "test")
+	<-gc.started
+	q.Add("second", "test")
+	q.Add("third", "test")
+	// stop with the first element in progress
+	q.Close()
+
+	processed := make(recordingConsumer, 3)
+	q, err = queue.NewDurable[string](processed, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := processed.expect(t, "first", "second", "third")
+	if items[0].Attempts != 2 || items[0].Trigger != "test" {
+		t.Errorf("got restored %+v, want it started the second time", items[0])
+	}
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("got journal %v %v, want it truncated", info, err)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	gc := newGatedConsumer()
+	q := queue.New[string](gc)
+	defer q.Close()
+	q.Coalesce(func(v string) string { return "target" })
+
+	q.Add("first", "test")
+	<-gc.started
+	q.Add("second", "test")
+	q.Add("third", "test")
+	q.Add("fourth", "test")
+	close(gc.gate)
+
+	for _, want := range []string{"first", "fourth"} {
+		select {
+		case got := <-gc.processed:
+			if got != want {
+				t.Errorf("got %s processed, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s was not processed", want)
 		}
 	}
+
+	skipped := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-gc.skipped:
+			skipped[v] = true
+		case <-time.After(time.Second):
+			t.Fatal("superseded elements were not skipped")
+		}
+	}
+	if !skipped["second"] || !skipped["third"] {
+		t.Errorf("got %v skipped, want second and third", skipped)
+	}
+}
+
+func TestSuperseded(t *testing.T) {
+	gc := newGatedConsumer()
+	q := queue.New[string](gc)
+	defer q.Close()
+
+	q.Add("a-1", "test")
+	<-gc.started
+	q.Add("a-2", "test")
+	if q.Superseded("a-1") {
+		t.Error("got a-1 superseded in a queue not coalescing")
+	}
+
+	q.Coalesce(func(v string) string { return strings.Split(v, "-")[0] })
+	if !q.Superseded("a-1") {
+		t.Error("got a-1 not superseded by the pending a-2")
+	}
+	if q.Superseded("b-1") {
+		t.Error("got b-1 superseded without pending item of its key")
+	}
+	close(gc.gate)
+}
+
+// failingConsumer fails processing each item until its attempts exceed failures
+type failingConsumer struct {
+	failures  int
+	err       error
+	processed chan *queue.Item[string]
+}
+
+func (fc *failingConsumer) Process(ctx context.Context, q *queue.Queue[string], item *queue.Item[string]) error {
+	if item.Attempts <= fc.failures {
+		return fc.err
+	}
+	fc.processed <- item
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	transient := errors.New("transient")
+	fc := &failingConsumer{failures: 2, err: transient, processed: make(chan *queue.Item[string], 1)}
+	q := queue.New[string](fc)
+	defer q.Close()
+	q.Retry(&queue.RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+		Jitter:      0.5,
+		Retryable:   func(err error) bool { return errors.Is(err, transient) },
+	})
+
+	q.Add("first", "test")
+	select {
+	case item := <-fc.processed:
+		if item.Attempts != 3 {
+			t.Errorf("got %d attempts, want 3", item.Attempts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first was not retried")
+	}
+
+	// a non retryable error isn't retried
+	fc.err = errors.New("permanent")
+	q.Add("second", "test")
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if q.Status() != queue.Failed || q.Current().Attempts != 1 {
+		t.Errorf("got %s after %d attempts, want failed after 1", q.Status(), q.Current().Attempts)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	fc := &failingConsumer{failures: 2, err: errors.New("failed"), processed: make(chan *queue.Item[string], 1)}
+	q := queue.New[string](fc)
+	defer q.Close()
+	// the second item may be attempted once more
+	policy := &queue.RetryPolicy{MaxAttempts: 2}
+
+	q.Add("first", "test")
+	q.AddItem(&queue.Item[string]{Value: "second", Trigger: "test", Retry: policy})
+	deadline := time.Now().Add(time.Second)
+	for len(q.DeadLetters()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	dl := q.DeadLetters()
+	if len(dl) != 2 || dl[0].Item.Value != "first" || dl[1].Item.Value != "second" || dl[1].Item.Attempts != 2 || dl[1].Error != "failed" {
+		t.Fatalf("got dead letters %v, want first and second after 2 attempts", dl)
+	}
+
+	if _, err := q.Redrive(dl[0].Item.ID+100, "redrive"); err == nil {
+		t.Error("got no error redriving an unknown item")
+	}
+	// the redriven item is attempted twice again by its policy and succeeds
+	fc.failures = 1
+	item, err := q.Redrive(dl[1].Item.ID, "redrive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-fc.processed:
+		if got != item || got.Trigger != "redrive" || got.Attempts != 2 {
+			t.Errorf("got %+v processed, want the redriven second", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("redriven second was not processed")
+	}
+	if dl := q.DeadLetters(); len(dl) != 1 || dl[0].Item.Value != "first" {
+		t.Errorf("got dead letters %v, want first", dl)
+	}
 }
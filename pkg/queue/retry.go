@@ -0,0 +1,56 @@
+package queue
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// maxDeadLetters is the number of dead letters kept, the oldest are dropped
+	maxDeadLetters = 100
+)
+
+// RetryPolicy configures retrying the items failed to process
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts processing an item, 0 or 1 disables retrying
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for every further one
+	Backoff time.Duration
+	// MaxBackoff limits the delay, 0 doesn't limit it
+	MaxBackoff time.Duration
+	// Jitter is the fraction of the delay it is randomly changed by, between 0 and 1
+	Jitter float64
+	// Retryable returns true if processing may succeed after the error,
+	// nil retries all errors
+	Retryable func(err error) bool
+}
+
+// retry returns true if the item failed with the error is retried by the policy
+func (p *RetryPolicy) retry(attempts int, err error) bool {
+	if p == nil || attempts >= p.MaxAttempts {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// backoff returns the delay before the retry after the attempts
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempts && (p.MaxBackoff == 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(p.Jitter * (2*rand.Float64() - 1) * float64(delay))
+	}
+	return delay
+}
+
+// DeadLetter is an item failed permanently
+type DeadLetter[T any] struct {
+	Item   *Item[T]
+	Error  string
+	Failed time.Time
+}
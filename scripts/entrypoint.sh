@@ -2,6 +2,4 @@
 
 set -euo pipefail
 
-/scripts/download-tools.sh
-
 exec /kitops s